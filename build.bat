@@ -54,11 +54,14 @@ CHDIR src\utilz
 8g.exe stringbuffer.go
 8g.exe timer.go
 8g.exe say.go
+8g.exe cache.go
 CHDIR ..\parse
 8g.exe -o gopt.8 option.go gopt.go
+8g.exe rules.go
+8g.exe -I ..\ diag.go
 cd ..\cmplr
-8g.exe -I ..\ dag.go
-8g.exe -I ..\ compiler.go
+8g.exe -I ..\ -o dag.8 dag.go lint.go dot.go export.go query.go critical.go header.go
+8g.exe -I ..\ -o compiler.8 compiler.go progress.go hermetic.go install.go linkmode.go cgo.go sources.go generate.go
 CHDIR ..\start
 8g.exe -I ..\ main.go
 8l.exe -L ..\ -o ..\..\gd.exe main.8
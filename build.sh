@@ -79,9 +79,12 @@ function build(){
     $COMPILER global.go || exit 1
     $COMPILER timer.go || exit 1
     $COMPILER say.go || exit 1
+    $COMPILER cache.go || exit 1
     cd $HERE/src/parse && $COMPILER -o gopt.$OBJ option.go gopt.go || exit 1
-    cd $HERE/src/cmplr && $COMPILER -I $IDIR dag.go || exit 1
-    $COMPILER -I $IDIR compiler.go || exit 1
+    $COMPILER rules.go || exit 1
+    $COMPILER -I $IDIR diag.go || exit 1
+    cd $HERE/src/cmplr && $COMPILER -I $IDIR -o dag.$OBJ dag.go lint.go dot.go export.go query.go critical.go header.go || exit 1
+    $COMPILER -I $IDIR -o compiler.$OBJ compiler.go progress.go hermetic.go install.go linkmode.go cgo.go sources.go generate.go || exit 1
     cd $HERE/src/start && $COMPILER -I $IDIR main.go || exit 1
     cd $HERE && $LINKY -o mgd -L src src/start/main.? || exit 1
     echo "...done"
@@ -94,18 +97,22 @@ function gccbuild(){
     gccgo -I src -c -o src/utilz/stringset.o src/utilz/stringset.go || exit 1
     gccgo -I src -c -o src/utilz/timer.o src/utilz/timer.go || exit 1
     gccgo -I src -c -o src/parse/gopt.o src/parse/gopt.go src/parse/option.go || exit 1
+    gccgo -I src -c -o src/parse/rules.o src/parse/rules.go || exit 1
+    gccgo -I src -c -o src/parse/diag.o src/parse/diag.go || exit 1
     gccgo -I src -c -o src/utilz/global.o src/utilz/global.go || exit 1
     gccgo -I src -c -o src/utilz/handy.o src/utilz/handy.go || exit 1
     gccgo -I src -c -o src/utilz/say.o src/utilz/say.go || exit 1
-    gccgo -I src -c -o src/cmplr/dag.o src/cmplr/dag.go || exit 1
-    gccgo -I src -c -o src/cmplr/compiler.o src/cmplr/compiler.go || exit 1
+    gccgo -I src -c -o src/utilz/cache.o src/utilz/cache.go || exit 1
+    gccgo -I src -c -o src/cmplr/dag.o src/cmplr/dag.go src/cmplr/lint.go src/cmplr/dot.go src/cmplr/export.go src/cmplr/query.go src/cmplr/critical.go src/cmplr/header.go || exit 1
+    gccgo -I src -c -o src/cmplr/compiler.o src/cmplr/compiler.go src/cmplr/progress.go src/cmplr/hermetic.go src/cmplr/install.go src/cmplr/linkmode.go src/cmplr/cgo.go src/cmplr/sources.go src/cmplr/generate.go || exit 1
     gccgo -I src -c -o src/start/main.o src/start/main.go || exit 1
     gccgo -o mgd -static src/start/main.o src/parse/gopt.o\
+        src/parse/rules.o src/parse/diag.o\
         src/utilz/stringset.o src/utilz/handy.o\
         src/utilz/stringbuffer.o src/utilz/walker.o\
         src/cmplr/dag.o src/utilz/say.o\
         src/utilz/global.o src/cmplr/compiler.o\
-        src/utilz/timer.o || exit 1
+        src/utilz/timer.o src/utilz/cache.o || exit 1
     echo "...done"
 }
 
@@ -120,10 +127,16 @@ function clean(){
     rm -rf src/utilz/handy.?
     rm -rf src/utilz/timer.?
     rm -rf src/utilz/say.?
+    rm -rf src/utilz/cache.?
     rm -rf src/cmplr/dag.?
     rm -rf src/cmplr/compiler.?
+    rm -rf src/cmplr/compiler_test.?
     rm -rf src/parse/gopt.?
     rm -rf src/parse/gopt_test.?
+    rm -rf src/parse/rules.?
+    rm -rf src/parse/rules_test.?
+    rm -rf src/parse/diag.?
+    rm -rf src/parse/diag_test.?
     rm -rf src/parse/option.?
     rm -rf src/start/main.?
     rm -rf mgd
@@ -0,0 +1,314 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "exec"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "utilz/handy"
+    "cmplr/dag"
+)
+
+// Packages with files that import "C" are built in a temporary
+// work directory, roughly like Make.pkg does it:
+//
+//  cgo [-gccgo] -- CFLAGS x.go ..     x.cgo1.go x.cgo2.c _cgo_* files
+//  compile Go files                   _go_.[568o]
+//  gcc -c the C files                 *.o
+//  gc: 6c _cgo_defun.c, and the dynamic imports found by linking
+//      the C objects (cgo -dynimport) compiled with 6c as well
+//  pack everything                    package archive (not main)
+//
+// CFLAGS and LDFLAGS come from $CGO_CFLAGS, $CGO_LDFLAGS and
+// '#cgo [GOOS|GOARCH|GOOS/GOARCH ..] CFLAGS|LDFLAGS: flags' lines,
+// gccgo gets the LDFLAGS of linked cgo packages when linking.
+// The cgo steps are not run hermetically (-hermetic).
+
+var pathCgo string
+var pathGcc string
+var pathCc string // gc: C compiler (6c, 8c, 5c)
+
+// one command of the cgo pipeline, run in dir, stdout to file
+type step struct {
+    argv   []string
+    dir    string
+    stdout string
+}
+
+func cgoTools() {
+
+    var err os.Error
+
+    if pathCgo != "" {
+        return
+    }
+
+    if global.GetString("-backend") == "express" {
+        log.Fatalf("[ERROR] cgo: not supported by backend: express\n")
+    }
+
+    if pathCgo, err = exec.LookPath("cgo"); err != nil {
+        log.Fatalf("[ERROR] cgo: %s\n", err)
+    }
+
+    if pathGcc, err = exec.LookPath("gcc"); err != nil {
+        log.Fatalf("[ERROR] cgo: %s\n", err)
+    }
+
+    if suffix != ".o" {
+        C := suffix[1:] + "c"
+        if pathCc, err = exec.LookPath(C); err != nil {
+            log.Fatalf("[ERROR] cgo: could not find C compiler: %s\n", C)
+        }
+    }
+
+    if pathPacker == "" {
+        packer()
+    }
+}
+
+// gcc flags for the architecture of gc
+func gccArch() []string {
+    switch suffix {
+    case ".6":
+        return []string{"-m64"}
+    case ".8":
+        return []string{"-m32"}
+    }
+    return []string{}
+}
+
+// cgo, compile Go files (argv) into goObject, C files into objdir;
+// the steps and the objects of pkg (goObject first)
+func cgoSteps(pkg *dag.Package, argv []string, goObject, work, objdir, prefix string) ([]step, []string) {
+
+    var steps []step
+
+    gccgo := (suffix == ".o")
+    goArgv := argv
+    cflags, ldflags := cgoFlags(pkg)
+    cgoFiles := make([]string, 0)
+
+    for i := 0; i < len(pkg.CgoFiles); i++ {
+        cgoFiles = append(cgoFiles, filepath.Base(pkg.CgoFiles[i]))
+    }
+
+    // cgo runs in work (see buildPackage)
+    argv = []string{pathCgo}
+    if gccgo {
+        argv = append(argv, "-gccgo")
+        if prefix != "" {
+            argv = append(argv, "-gccgoprefix="+prefix)
+        }
+    }
+    argv = append(argv, "--")
+    argv = append(argv, "-I", absPath(filepath.Dir(pkg.CgoFiles[0])))
+    argv = append(argv, cflags...)
+    argv = append(argv, cgoFiles...)
+
+    steps = append(steps, step{argv: argv, dir: work})
+
+    // Go: files without import "C" and what cgo made of the rest
+    goFiles := make([]string, 0)
+    cFiles := []string{filepath.Join(work, "_cgo_export.c")}
+    isCgo := make(map[string]bool)
+
+    for i := 0; i < len(pkg.CgoFiles); i++ {
+        isCgo[pkg.CgoFiles[i]] = true
+    }
+
+    for i := 0; i < len(pkg.Files); i++ {
+        if !isCgo[pkg.Files[i]] {
+            goFiles = append(goFiles, pkg.Files[i])
+        }
+    }
+
+    for i := 0; i < len(cgoFiles); i++ {
+        base := cgoFiles[i][:len(cgoFiles[i])-len(".go")]
+        goFiles = append(goFiles, filepath.Join(work, base+".cgo1.go"))
+        cFiles = append(cFiles, filepath.Join(work, base+".cgo2.c"))
+    }
+
+    goFiles = append(goFiles, filepath.Join(work, "_cgo_gotypes.go"))
+
+    argv = withOutput(goArgv, goObject)
+    argv = append(argv[:len(argv)-len(pkg.Files)], goFiles...)
+
+    steps = append(steps, step{argv: argv})
+
+    objects := []string{goObject}
+    cObjects := make([]string, 0)
+
+    if !gccgo {
+        cFiles = append(cFiles, filepath.Join(work, "_cgo_main.c"))
+    }
+
+    for i := 0; i < len(cFiles); i++ {
+        object := filepath.Base(cFiles[i])
+        object = filepath.Join(objdir, object[:len(object)-len(".c")]+".o")
+        if filepath.Base(cFiles[i]) == "_cgo_main.c" {
+            object = filepath.Join(work, "_cgo_main.o") // never linked
+        }
+        argv = []string{pathGcc}
+        argv = append(argv, gccArch()...)
+        argv = append(argv, "-fPIC", "-O2", "-c", "-I", work)
+        argv = append(argv, "-I", absPath(filepath.Dir(pkg.CgoFiles[0])))
+        argv = append(argv, cflags...)
+        argv = append(argv, "-o", object, cFiles[i])
+        steps = append(steps, step{argv: argv})
+        cObjects = append(cObjects, object)
+    }
+
+    if !gccgo {
+
+        // _cgo_main.o only lets the dynamic imports be found
+        dynobj := filepath.Join(work, "_cgo1_.o")
+        argv = []string{pathGcc}
+        argv = append(argv, gccArch()...)
+        argv = append(argv, "-o", dynobj)
+        argv = append(argv, cObjects...)
+        argv = append(argv, ldflags...)
+        steps = append(steps, step{argv: argv})
+
+        dynimport := filepath.Join(work, "_cgo_import.c")
+        argv = []string{pathCgo, "-dynimport", dynobj}
+        steps = append(steps, step{argv: argv, stdout: dynimport})
+
+        for _, c := range []string{"_cgo_defun", "_cgo_import"} {
+            object := filepath.Join(objdir, c+suffix)
+            argv = []string{pathCc, "-FVw", "-I", work, "-I", stdlib}
+            argv = append(argv, "-o", object, filepath.Join(work, c+".c"))
+            steps = append(steps, step{argv: argv})
+            objects = append(objects, object)
+        }
+
+        cObjects = cObjects[:len(cObjects)-1] // not _cgo_main.o
+    }
+
+    objects = append(objects, cObjects...)
+
+    sources, sourceObjects := sourceSteps(pkg, objdir, cflags)
+    steps = append(steps, sources...)
+    objects = append(objects, sourceObjects...)
+
+    return steps, objects
+}
+
+func runStep(s step, output *bytes.Buffer) bool {
+
+    var stdout bytes.Buffer
+
+    cmd := exec.Command(s.argv[0], s.argv[1:]...)
+    cmd.Dir = s.dir
+    cmd.Stdout = output
+    cmd.Stderr = output
+
+    if s.stdout != "" {
+        cmd.Stdout = &stdout
+    }
+
+    e := handy.Run(cmd)
+
+    if e == nil && s.stdout != "" {
+        e = ioutil.WriteFile(s.stdout, stdout.Bytes(), 0644)
+    }
+
+    if e != nil {
+        fmt.Fprintf(output, "[ERROR] %s: %s\n", filepath.Base(s.argv[0]), e)
+        return false
+    }
+
+    return true
+}
+
+// CFLAGS and LDFLAGS of a cgo package
+func cgoFlags(pkg *dag.Package) (cflags, ldflags []string) {
+
+    cflags = strings.Fields(os.Getenv("CGO_CFLAGS"))
+    ldflags = strings.Fields(os.Getenv("CGO_LDFLAGS"))
+
+    for i := 0; i < len(pkg.CgoFiles); i++ {
+
+        b, e := ioutil.ReadFile(pkg.CgoFiles[i])
+
+        if e != nil {
+            continue
+        }
+
+        lines := strings.Split(string(b), "\n", -1)
+
+        for j := 0; j < len(lines); j++ {
+
+            line := strings.TrimSpace(strings.TrimLeft(lines[j], " \t/"))
+
+            if !strings.HasPrefix(line, "#cgo ") {
+                continue
+            }
+
+            colon := strings.Index(line, ":")
+            if colon < 0 {
+                continue
+            }
+
+            words := strings.Fields(line[len("#cgo "):colon])
+            if len(words) == 0 || !cgoMatch(words[:len(words)-1]) {
+                continue
+            }
+
+            switch words[len(words)-1] {
+            case "CFLAGS":
+                cflags = append(cflags, strings.Fields(line[colon+1:])...)
+            case "LDFLAGS":
+                ldflags = append(ldflags, strings.Fields(line[colon+1:])...)
+            default:
+                log.Printf("[WARNING] %s: unknown #cgo directive: %s\n",
+                    pkg.CgoFiles[i], line)
+            }
+        }
+    }
+
+    return cflags, ldflags
+}
+
+// conditions of a #cgo line, nothing or one of GOOS, GOARCH, GOOS/GOARCH
+func cgoMatch(conditions []string) bool {
+
+    if len(conditions) == 0 {
+        return true
+    }
+
+    osArch := strings.Split(platform(), "_", 2)
+
+    for i := 0; i < len(conditions); i++ {
+        switch conditions[i] {
+        case osArch[0], osArch[1], osArch[0] + "/" + osArch[1]:
+            return true
+        }
+    }
+
+    return false
+}
+
+// gccgo: LDFLAGS of the cgo packages linked
+func cgoLinkFlags(pkgs []*dag.Package) []string {
+
+    ldflags := make([]string, 0)
+
+    for i := 0; i < len(pkgs); i++ {
+        if pkgs[i].Cgo() {
+            _, flags := cgoFlags(pkgs[i])
+            ldflags = append(ldflags, flags...)
+        }
+    }
+
+    return ldflags
+}
@@ -9,14 +9,23 @@ import (
     "fmt"
     "log"
     "exec"
+    "crypto/sha1"
+    "encoding/hex"
+    "debug/elf"
+    "bytes"
+    "io/ioutil"
     "strings"
     "regexp"
+    "sort"
+    "runtime"
     "path/filepath"
     "utilz/walker"
     "utilz/stringset"
     "utilz/handy"
     "utilz/say"
     "utilz/global"
+    "utilz/cache"
+    "parse/diag"
     "cmplr/dag"
 )
 
@@ -27,6 +36,12 @@ var libroot string
 var pathLinker string
 var pathCompiler string
 var suffix string
+var stdlib string // compiled standard library (gc, gccgo), "" if unknown
+var buildCache cache.Cache // nil if no cache is used
+var toolchain string // hash of compiler binary, part of cache keys
+var diagnostics = stringset.New() // compiler errors reported so far
+var pathPacker string // gopack (gc) or ar (gccgo), only for -pack
+var objectRoots = make(map[*dag.Package]string) // not below libroot
 
 
 func Init(srcdir, arch string, include []string) {
@@ -40,6 +55,10 @@ func Init(srcdir, arch string, include []string) {
         libroot = srcroot
     }
 
+    if global.GetBool("-reproducible") {
+        reproducible()
+    }
+
     switch global.GetString("-backend") {
     case "gcc", "gccgo":
         gcc()
@@ -51,6 +70,30 @@ func Init(srcdir, arch string, include []string) {
         log.Fatalf("[ERROR] '%s' unknown backend\n",
             global.GetString("-backend"))
     }
+
+    if global.GetBool("-pack") {
+        packer()
+    }
+}
+
+// -pack: archive tool of the backend
+func packer() {
+
+    var err os.Error
+
+    switch global.GetString("-backend") {
+    case "gc":
+        pathPacker, err = exec.LookPath("gopack")
+    case "gcc", "gccgo":
+        pathPacker, err = exec.LookPath("ar")
+    default:
+        log.Fatalf("[ERROR] -pack: not supported by backend: %s\n",
+            global.GetString("-backend"))
+    }
+
+    if err != nil {
+        log.Fatalf("[ERROR] -pack: %s\n", err)
+    }
 }
 
 func express() {
@@ -116,6 +159,12 @@ func gc(arch string) {
 
     suffix = S
 
+    O := os.Getenv("GOOS")
+    if O == "" {
+        O = runtime.GOOS
+    }
+
+    stdlib = filepath.Join(os.Getenv("GOROOT"), "pkg", O+"_"+A)
 }
 
 func gcc() {
@@ -131,8 +180,115 @@ func gcc() {
     pathLinker = pathCompiler
 
     suffix = ".o"
+
+    stdlib = gccgoStdlib()
+}
+
+// gccgo installs the export data (.gox) of the standard library
+// in libdir/go/VERSION/MACHINE, libdir is where libgo is; "" if
+// that is not where it is
+func gccgoStdlib() string {
+
+    query := func(arg string) string {
+        output, ok := handy.Capture([]string{pathCompiler, arg})
+        if !ok {
+            return ""
+        }
+        return strings.TrimSpace(string(output))
+    }
+
+    libgo := query("-print-file-name=libgo.so")
+    version := query("-dumpversion")
+    machine := query("-dumpmachine")
+
+    if !filepath.IsAbs(libgo) || version == "" || machine == "" {
+        return ""
+    }
+
+    dir := filepath.Join(filepath.Dir(libgo), "go", version, machine)
+
+    if !handy.IsDir(dir) {
+        return ""
+    }
+
+    return dir
+}
+
+
+// Normalise what gd controls so that two machines produce identical
+// output: -I order (files are sorted in CreateArgv) and environment.
+func reproducible() {
+
+    sorted := make([]string, len(includes))
+    copy(sorted, includes)
+    sort.SortStrings(sorted)
+    includes = sorted
+
+    for k, v := range reproducibleEnv {
+        os.Setenv(k, v)
+    }
+}
+
+var reproducibleEnv = map[string]string{
+    "LANG":              "C",
+    "LC_ALL":            "C",
+    "TZ":                "UTC",
+    "SOURCE_DATE_EPOCH": "0",
+}
+
+// Consult (and fill) c before compiling anything, Init first.
+func InitCache(c cache.Cache) {
+    buildCache = c
+    if c != nil {
+        toolchain = hashFile(pathCompiler)
+    }
 }
 
+// Report imports that cannot be resolved against the source-tree,
+// -lib, -I or the standard library before anything gets compiled.
+func CheckImports(d dag.Dag) {
+
+    dirs := make([]string, 0)
+    dirs = append(dirs, libroot)
+    dirs = append(dirs, includes...)
+
+    if stdlib != "" {
+        dirs = append(dirs, stdlib)
+    }
+
+    suffixes := []string{suffix, ".a"}
+
+    if suffix == ".o" {
+        suffixes = append(suffixes, ".gox") // gccgo stdlib
+    }
+
+    missing := d.MissingImports(dirs, suffixes)
+
+    imprts := make([]string, 0)
+
+    for imprt, _ := range missing {
+        // without a known stdlib only remote-looking imports are checked
+        if stdlib != "" || strings.Contains(strings.Split(imprt, "/", 2)[0], ".") {
+            imprts = append(imprts, imprt)
+        }
+    }
+
+    if len(imprts) == 0 {
+        return
+    }
+
+    sort.SortStrings(imprts)
+
+    for i := 0; i < len(imprts); i++ {
+        locations := missing[imprts[i]]
+        for j := 0; j < len(locations); j++ {
+            log.Printf("[ERROR] %s: cannot find package \"%s\"\n",
+                locations[j], imprts[i])
+        }
+    }
+
+    log.Fatalf("[ERROR] %d unresolved import(s)\n", len(imprts))
+}
 
 func CreateArgv(pkgs []*dag.Package) {
 
@@ -142,6 +298,14 @@ func CreateArgv(pkgs []*dag.Package) {
 
     for y := 0; y < len(pkgs); y++ {
 
+        if pkgs[y].Cgo() {
+            cgoTools()
+        }
+
+        if len(pkgs[y].Sources) > 0 {
+            sourceTools()
+        }
+
         argv = make([]string, 0)
         argv = append(argv, pathCompiler)
         argv = append(argv, "-I")
@@ -154,15 +318,24 @@ func CreateArgv(pkgs []*dag.Package) {
         switch global.GetString("-backend") {
         case "gcc", "gccgo":
             argv = append(argv, "-c")
+            if positionIndependent() {
+                argv = append(argv, "-fPIC")
+            }
         }
 
         argv = append(argv, "-o")
-        argv = append(argv, filepath.Join(libroot, pkgs[y].Name)+suffix)
+        argv = append(argv, objectFile(pkgs[y]))
+
+        files := pkgs[y].Files
 
-        for z := 0; z < len(pkgs[y].Files); z++ {
-            argv = append(argv, pkgs[y].Files[z])
+        if global.GetBool("-reproducible") {
+            files = make([]string, len(pkgs[y].Files))
+            copy(files, pkgs[y].Files)
+            sort.SortStrings(files)
         }
 
+        argv = append(argv, files...)
+
         pkgs[y].Argv = argv
     }
 }
@@ -185,24 +358,43 @@ func CreateLibArgv(pkgs []*dag.Package) {
 
 }
 
+// test main is compiled into its work directory (named like its
+// package dir), whether -lib is given or not, never below srcdir
+func CreateTestMainArgv(pkgs []*dag.Package, workdir string) {
+
+    for i := 0; i < len(pkgs); i++ {
+        objectRoots[pkgs[i]] = filepath.Dir(workdir)
+    }
+
+    CreateArgv(pkgs)
+}
+
 func SerialCompile(pkgs []*dag.Package) {
 
     var oldPkgFound bool = false
 
+    progressStart(len(pkgs))
+
     for y := 0; y < len(pkgs); y++ {
 
         if global.GetBool("-dryrun") {
-            fmt.Printf("%s || exit 1\n", strings.Join(pkgs[y].Argv, " "))
+            if packed(pkgs[y]) || hasLoose(pkgs[y]) {
+                object := objectFile(pkgs[y])
+                printBuild(pkgs[y], pkgs[y].Argv, object, looseDir(object), "")
+            } else {
+                fmt.Printf("%s || exit 1\n", strings.Join(pkgs[y].Argv, " "))
+            }
         } else {
             if oldPkgFound || !pkgs[y].UpToDate() {
-                say.Println("compiling:", pkgs[y].Name)
-                handy.StdExecve(pkgs[y].Argv, true)
+                compileOrDie(pkgs[y])
                 oldPkgFound = true
             } else {
-                say.Println("up 2 date:", pkgs[y].Name)
+                progressSkip("up 2 date:", pkgs[y].Name)
             }
         }
     }
+
+    progressStop()
 }
 
 func ParallelCompile(pkgs []*dag.Package) {
@@ -240,6 +432,8 @@ func ParallelCompile(pkgs []*dag.Package) {
 
     parallel = make([]*dag.Package, 0)
 
+    progressStart(len(pkgs))
+
     for y = 0; y < len(zeroFirst); {
 
         if !zeroFirst[y].Ready(localDeps, compiledDeps) {
@@ -262,13 +456,14 @@ func ParallelCompile(pkgs []*dag.Package) {
         _ = compileMultipe(parallel, oldPkgFound)
     }
 
+    progressStop()
 }
 
 func compileMultipe(pkgs []*dag.Package, oldPkgFound bool) bool {
 
-    var ok bool
     var max int = len(pkgs)
-    var trouble bool = false
+    var running int = 0
+    var failed []string
 
     if max == 0 {
         log.Fatal("[ERROR] trying to compile 0 packages in parallel\n")
@@ -276,46 +471,420 @@ func compileMultipe(pkgs []*dag.Package, oldPkgFound bool) bool {
 
     if max == 1 {
         if oldPkgFound || !pkgs[0].UpToDate() {
-            say.Println("compiling:", pkgs[0].Name)
-            handy.StdExecve(pkgs[0].Argv, true)
+            compileOrDie(pkgs[0])
             oldPkgFound = true
         } else {
-            say.Println("up 2 date:", pkgs[0].Name)
+            progressSkip("up 2 date:", pkgs[0].Name)
         }
     } else {
 
-        ch := make(chan bool, max)
+        ch := make(chan *job, max)
 
         for y := 0; y < max; y++ {
             if oldPkgFound || !pkgs[y].UpToDate() {
-                say.Println("compiling:", pkgs[y].Name)
                 oldPkgFound = true
-                go gCompile(pkgs[y].Argv, ch)
+                j := newJob(pkgs[y])
+                if !j.fromCache() {
+                    progressBegin(pkgs[y].Name)
+                    running++
+                    go gCompile(j, ch)
+                }
             } else {
-                say.Println("up 2 date:", pkgs[y].Name)
-                ch <- true
+                progressSkip("up 2 date:", pkgs[y].Name)
             }
         }
 
-        // drain channel (make sure all jobs are finished)
-        for z := 0; z < max; z++ {
-            ok = <-ch
-            if !ok {
-                trouble = true
+        // drain channel (make sure all jobs are finished),
+        // output of each job is printed when it is done
+        failed = make([]string, 0)
+
+        for z := 0; z < running; z++ {
+            j := <-ch
+            progressEnd(j.pkg.Name)
+            clearStatus()
+            j.report()
+            drawStatus()
+            if !j.ok {
+                failed = append(failed, j.pkg.Name)
             }
         }
     }
 
-    if trouble {
-        log.Fatal("[ERROR] failed batch compile job\n")
+    if len(failed) > 0 {
+        progressStop()
+        log.Printf("[ERROR] failed to compile %d package(s):\n", len(failed))
+        for i := 0; i < len(failed); i++ {
+            log.Printf("[ERROR]   %s\n", failed[i])
+        }
+        log.Print("[ERROR] failed batch compile job\n")
+        handy.Exit(1)
     }
 
     return oldPkgFound
 }
 
-func gCompile(argv []string, c chan bool) {
-    ok := handy.StdExecve(argv, false) // don't exit on error
-    c <- ok
+func gCompile(j *job, c chan *job) {
+    j.run()
+    c <- j
+}
+
+func compileOrDie(pkg *dag.Package) {
+
+    j := newJob(pkg)
+
+    if j.fromCache() {
+        return
+    }
+
+    progressBegin(pkg.Name)
+
+    j.run()
+
+    progressEnd(pkg.Name)
+    clearStatus()
+    j.report()
+
+    if !j.ok {
+        log.Printf("[ERROR] failed to compile: %s\n", pkg.Name)
+        handy.Exit(1)
+    }
+
+    drawStatus()
+}
+
+// compilation of a single package, output from the compiler is
+// buffered so that parallel jobs don't garble each others output
+type job struct {
+    pkg    *dag.Package
+    key    string // build cache key
+    ok     bool
+    output []byte
+}
+
+func newJob(pkg *dag.Package) *job {
+    j := new(job)
+    j.pkg = pkg
+    return j
+}
+
+// true if the object could be fetched from the build cache
+func (j *job) fromCache() bool {
+
+    // the cache holds a single object per package
+    if buildCache == nil || hasLoose(j.pkg) {
+        return false
+    }
+
+    j.key = cacheKey(j.pkg)
+
+    if buildCache.Get(j.key, objectFile(j.pkg)) {
+        progressSkip("cached   :", j.pkg.Name)
+        j.ok = true
+        return true
+    }
+
+    return false
+}
+
+// the compiler writes to a temporary name, the object is renamed
+// into place when complete, an interrupted compile never leaves a
+// (fresh looking) truncated object for UpToDate to trust
+func (j *job) run() {
+
+    object := objectFile(j.pkg)
+    partial := partialFile(object)
+
+    handy.Partial(partial)
+
+    j.output, j.ok = buildPackage(j.pkg, j.pkg.Argv, partial, looseDir(object), "")
+
+    if j.ok {
+        if e := os.Rename(partial, object); e != nil {
+            j.output = append(j.output, []byte(fmt.Sprintf("[ERROR] %s\n", e))...)
+            j.ok = false
+        }
+    } else {
+        os.Remove(partial)
+    }
+
+    handy.Complete(partial)
+
+    if j.ok && buildCache != nil && !hasLoose(j.pkg) {
+        e := buildCache.Put(j.key, objectFile(j.pkg))
+        if e != nil {
+            log.Printf("[WARNING] build cache: %s\n", e)
+        }
+    }
+}
+
+// print compiler output in one piece (with package name on top),
+// and save it below -log-dir if that is set; diagnostics get paths
+// relative to the current directory and the offending source line
+func (j *job) report() {
+
+    output := diag.Rewrite(string(j.output), diagnostics)
+
+    if strings.TrimSpace(output) != "" {
+        status := ""
+        if !j.ok {
+            status = " (failed)"
+        }
+        fmt.Fprintf(os.Stderr, "--- %s%s\n%s", j.pkg.Name, status, output)
+        if !strings.HasSuffix(output, "\n") {
+            fmt.Fprintln(os.Stderr, "")
+        }
+    }
+
+    if global.GetString("-log-dir") != "" {
+
+        logfile := filepath.Join(global.GetString("-log-dir"), j.pkg.Name) + ".log"
+        handy.DirOrMkdir(filepath.Dir(logfile))
+
+        content := strings.Join(j.pkg.Argv, " ") + "\n" + string(j.output)
+        e := ioutil.WriteFile(logfile, []byte(content), 0644)
+
+        if e != nil {
+            log.Printf("[ERROR] %s\n", e)
+        }
+    }
+}
+
+// argv with the -o argument replaced
+func withOutput(argv []string, output string) []string {
+
+    replaced := make([]string, len(argv))
+
+    for i := 0; i < len(argv); i++ {
+        if i > 0 && argv[i-1] == "-o" {
+            replaced[i] = output
+        } else {
+            replaced[i] = argv[i]
+        }
+    }
+
+    return replaced
+}
+
+// -pack: packages (not programs) are archives, packages with cgo
+// or .s/.c files always are (Go and other objects packed together),
+// main packages never are (see looseDir)
+func packed(pkg *dag.Package) bool {
+    return pkg.ShortName != "main" &&
+        (global.GetBool("-pack") || pkg.Cgo() || len(pkg.Sources) > 0)
+}
+
+func packArgv(archive, object string) []string {
+    switch global.GetString("-backend") {
+    case "gcc", "gccgo":
+        return []string{pathPacker, "rcs", archive, object}
+    }
+    return []string{pathPacker, "grc", archive, object}
+}
+
+// compiled package relative to libroot: object, or archive (gc:
+// name.a, gccgo: dir/libname.a which is where gccgo looks for it)
+func objectName(pkg *dag.Package) string {
+
+    if !packed(pkg) {
+        return pkg.Name + suffix
+    }
+
+    switch global.GetString("-backend") {
+    case "gcc", "gccgo":
+        dir, base := filepath.Split(pkg.Name)
+        return filepath.Join(dir, "lib"+base+".a")
+    }
+
+    return pkg.Name + ".a"
+}
+
+func objectFile(pkg *dag.Package) string {
+    return filepath.Join(objectRoot(pkg), objectName(pkg))
+}
+
+// libroot, or where CreateTestMainArgv put pkg
+func objectRoot(pkg *dag.Package) string {
+    if root, ok := objectRoots[pkg]; ok {
+        return root
+    }
+    return libroot
+}
+
+func partialFile(object string) string {
+    return fmt.Sprintf("%s.gdtmp%d", object, os.Getpid())
+}
+
+// Remove what interrupted (killed) compiles may have left behind:
+// partial objects, and objects which are truncated or broken.
+func RemoveStale(pkgs []*dag.Package) {
+
+    if global.GetBool("-dryrun") {
+        return
+    }
+
+    for i := 0; i < len(pkgs); i++ {
+
+        object := objectFile(pkgs[i])
+        partials, _ := filepath.Glob(object + ".gdtmp*")
+
+        for j := 0; j < len(partials); j++ {
+            if os.Remove(partials[j]) == nil {
+                log.Printf("[WARNING] removed partial object: %s\n", partials[j])
+            }
+        }
+
+        if _, e := os.Stat(object); e == nil && !validObject(object) {
+            if os.Remove(object) == nil {
+                log.Printf("[WARNING] removed broken object: %s\n", object)
+            }
+        }
+    }
+}
+
+// header check: gc objects start with 'go object', and the
+// export data must be complete, ELF objects must be parsable
+func validObject(pathname string) bool {
+
+    b, e := ioutil.ReadFile(pathname)
+
+    if e != nil || len(b) == 0 {
+        return false
+    }
+
+    if strings.HasSuffix(pathname, ".a") {
+        return bytes.HasPrefix(b, []byte("!<arch>\n"))
+    }
+
+    switch suffix {
+    case ".5", ".6", ".8":
+        return bytes.HasPrefix(b, []byte("go object ")) &&
+            bytes.Contains(b, []byte("\n!\n"))
+    case ".o":
+        if bytes.HasPrefix(b, []byte(elf.ELFMAG)) {
+            f, e := elf.Open(pathname)
+            if e != nil {
+                return false
+            }
+            f.Close()
+        }
+    }
+
+    return true
+}
+
+// compiled package (import) in -lib or -I directories, "" if missing
+func findObject(imprt string) string {
+
+    dirs := append([]string{libroot}, includes...)
+
+    dir, base := filepath.Split(imprt)
+
+    for i := 0; i < len(dirs); i++ {
+        candidates := []string{
+            filepath.Join(dirs[i], imprt) + suffix,
+            filepath.Join(dirs[i], imprt) + ".a",
+            filepath.Join(dirs[i], dir, "lib"+base+".a"), // gccgo
+        }
+        for _, pathname := range candidates {
+            if fileinfo, e := os.Stat(pathname); e == nil && fileinfo.IsRegular() {
+                return pathname
+            }
+        }
+    }
+
+    return ""
+}
+
+// Everything the compiled object depends on: the compiler itself,
+// its arguments, the source files and the objects of the imports.
+// Paths that differ between machines (-lib, output) are left out.
+func cacheKey(pkg *dag.Package) string {
+
+    h := sha1.New()
+
+    fmt.Fprintf(h, "toolchain %s\n", toolchain)
+
+    for i := 1; i < len(pkg.Argv); i++ {
+        arg := pkg.Argv[i]
+        if arg == libroot {
+            arg = "$LIB"
+        } else if arg == objectFile(pkg) {
+            arg = "$OUT"
+        }
+        fmt.Fprintf(h, "arg %s\n", arg)
+    }
+
+    for i := 0; i < len(pkg.Files); i++ {
+        fmt.Fprintf(h, "file %s %s\n", pkg.Files[i], hashFile(pkg.Files[i]))
+    }
+
+    for i := 0; i < len(pkg.Sources); i++ {
+        fmt.Fprintf(h, "source %s %s\n", pkg.Sources[i], hashFile(pkg.Sources[i]))
+    }
+
+    // cgo and .s/.c files: the other tools and their flags
+    if pkg.Cgo() || len(pkg.Sources) > 0 {
+
+        tools := []string{pathCgo, pathGcc, pathCc, pathAsm, pathPacker}
+
+        for i := 0; i < len(tools); i++ {
+            if tools[i] != "" {
+                fmt.Fprintf(h, "tool %s %s\n", tools[i], hashFile(tools[i]))
+            }
+        }
+
+        fmt.Fprintf(h, "env CGO_CFLAGS %s\n", os.Getenv("CGO_CFLAGS"))
+        fmt.Fprintf(h, "env CGO_LDFLAGS %s\n", os.Getenv("CGO_LDFLAGS"))
+
+        if pkg.Cgo() {
+            cflags, ldflags := cgoFlags(pkg)
+            fmt.Fprintf(h, "cflags %s\n", strings.Join(cflags, " "))
+            fmt.Fprintf(h, "ldflags %s\n", strings.Join(ldflags, " "))
+        }
+    }
+
+    deps := pkg.Dependencies()
+
+    for i := 0; i < len(deps); i++ {
+        if object := findObject(deps[i]); object != "" {
+            fmt.Fprintf(h, "import %s %s\n", deps[i], hashFile(object))
+        }
+    }
+
+    return hex.EncodeToString(h.Sum())
+}
+
+func hashFile(pathname string) string {
+
+    b, e := ioutil.ReadFile(pathname)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    h := sha1.New()
+    h.Write(b)
+
+    return hex.EncodeToString(h.Sum())
+}
+
+// remove objects of packages, and the directories (below
+// libroot) holding them if they end up empty
+func DeleteObjects(pkgs []*dag.Package) {
+
+    for i := 0; i < len(pkgs); i++ {
+
+        object := objectFile(pkgs[i])
+
+        os.Remove(object)
+
+        for dir := filepath.Dir(object); len(dir) > len(objectRoot(pkgs[i])); {
+            if os.Remove(dir) != nil {
+                break
+            }
+            dir = filepath.Dir(dir)
+        }
+    }
 }
 
 // for removal of temoprary packages created for testing and so on..
@@ -334,7 +903,7 @@ func DeletePackages(pkgs []*dag.Package) bool {
             }
         }
         if !global.GetBool("-dryrun") {
-            pcompile := filepath.Join(libroot, pkgs[i].Name) + suffix
+            pcompile := objectFile(pkgs[i])
             e = os.Remove(pcompile)
             if e != nil {
                 ok = false
@@ -349,7 +918,48 @@ func DeletePackages(pkgs []*dag.Package) bool {
 
 func ForkLink(output string, pkgs []*dag.Package, extra []*dag.Package) {
 
-    var mainPKG *dag.Package
+    mainPKG := mainPackage(pkgs)
+    mode := linkMode(mainPKG)
+
+    if mode == archiveMode {
+        linkArchive(output, linkObjects(mainPKG, pkgs, extra))
+        writeHeader(output, mainPKG)
+        return
+    }
+
+    argv := linkArgv(output, mainPKG, mode, pkgs, extra)
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("%s || exit 1\n", strings.Join(argv, " "))
+    } else {
+        say.Println("linking  :", output)
+        handy.Partial(output)
+        defer handy.Complete(output)
+        if global.GetBool("-hermetic") {
+            out, ok := hermetic(argv, linkInputs(pkgs, extra), output)
+            os.Stderr.Write(out)
+            if !ok {
+                log.Printf("[ERROR] failed to link: %s\n", output)
+                handy.Exit(1)
+            }
+        } else {
+            handy.StdExecve(argv, true)
+        }
+    }
+
+    if mode != exeMode {
+        writeHeader(output, mainPKG)
+    }
+}
+
+// the command ForkLink runs (not for c-archive, see linkArchive)
+func LinkArgv(output string, pkgs []*dag.Package, extra []*dag.Package) []string {
+    mainPKG := mainPackage(pkgs)
+    return linkArgv(output, mainPKG, linkMode(mainPKG), pkgs, extra)
+}
+
+// the main package of pkgs (-main picks one if there are several)
+func mainPackage(pkgs []*dag.Package) *dag.Package {
 
     gotMain := make([]*dag.Package, 0)
 
@@ -364,13 +974,13 @@ func ForkLink(output string, pkgs []*dag.Package, extra []*dag.Package) {
     }
 
     if len(gotMain) > 1 {
-        choice := mainChoice(gotMain)
-        mainPKG = gotMain[choice]
-    } else {
-        mainPKG = gotMain[0]
+        return gotMain[mainChoice(gotMain)]
     }
 
-    compiled := filepath.Join(libroot, mainPKG.Name) + suffix
+    return gotMain[0]
+}
+
+func linkArgv(output string, mainPKG *dag.Package, mode string, pkgs, extra []*dag.Package) []string {
 
     argv := make([]string, 0)
     argv = append(argv, pathLinker)
@@ -384,24 +994,19 @@ func ForkLink(output string, pkgs []*dag.Package, extra []*dag.Package) {
     argv = append(argv, "-o")
     argv = append(argv, output)
 
-    // gcc get's this no matter what...
+    // gcc get's this no matter what... (unless it's a shared object)
     if global.GetString("-backend") == "gcc" ||
         global.GetString("-backend") == "gccgo" {
-        argv = append(argv, "-static")
+        if mode == sharedMode {
+            argv = append(argv, "-shared", "-fPIC")
+        } else {
+            argv = append(argv, "-static")
+        }
     } else if global.GetBool("-static") {
         argv = append(argv, "-d")
     }
 
     switch global.GetString("-backend") {
-    case "gccgo", "gcc":
-        walker.IncludeFile = func(s string) bool {
-            return strings.HasSuffix(s, ".o")
-        }
-        walker.IncludeDir = func(s string) bool { return true }
-
-        for y := 0; y < len(includes); y++ {
-            argv = append(argv, walker.PathWalk(includes[y])...)
-        }
     case "gc", "express":
         for y := 0; y < len(includes); y++ {
             argv = append(argv, "-L")
@@ -409,40 +1014,162 @@ func ForkLink(output string, pkgs []*dag.Package, extra []*dag.Package) {
         }
     }
 
-    argv = append(argv, compiled)
+    argv = append(argv, linkObjects(mainPKG, pkgs, extra)...)
+
+    // gccgo: libraries wanted by cgo packages
+    if suffix == ".o" {
+        argv = append(argv, cgoLinkFlags(pkgs)...)
+        argv = append(argv, cgoLinkFlags(extra)...)
+    }
+
+    return argv
+}
+
+// object of main (and its loose objects), for gccgo followed
+// by what main needs, in link order
+func linkObjects(mainPKG *dag.Package, pkgs, extra []*dag.Package) []string {
+
+    compiled := objectFile(mainPKG)
+
+    objects := []string{compiled}
+    objects = append(objects, looseObjects(compiled)...)
 
     if global.GetString("-backend") == "gcc" ||
         global.GetString("-backend") == "gccgo" {
+        objects = append(objects, linkClosure(mainPKG, pkgs, extra)...)
+    }
 
-        ss := stringset.New()
+    return objects
+}
 
-        if len(extra) > 0 {
-            for j := 0; j < len(extra); j++ {
-                // main package untestable using GCC
-                if extra[j].ShortName != "main" {
-                    ss.Add(filepath.Join(libroot, extra[j].Name) + suffix)
-                }
+// objects to link with main (gccgo): local packages and objects
+// below -I reachable from main, each one before the objects it
+// depends on; the standard library is linked by gccgo itself
+func linkClosure(mainPKG *dag.Package, pkgs, extra []*dag.Package) []string {
+
+    local := make(map[string]*dag.Package)
+
+    for i := 0; i < len(extra); i++ {
+        local[extra[i].Name] = extra[i]
+    }
+
+    for i := 0; i < len(pkgs); i++ {
+        local[pkgs[i].Name] = pkgs[i]
+    }
+
+    visited := stringset.New()
+    objects := make([]string, 0)
+
+    // post order: dependencies first
+    var visit func(imprt string)
+
+    visit = func(imprt string) {
+
+        if !visited.Add(imprt) {
+            return
+        }
+
+        if pkg, ok := local[imprt]; ok {
+            deps := pkg.Dependencies()
+            for i := 0; i < len(deps); i++ {
+                visit(deps[i])
             }
-        } else {
-            for k := 0; k < len(pkgs); k++ {
-                ss.Add(filepath.Join(libroot, pkgs[k].Name) + suffix)
+            if pkg == mainPKG {
+                return
+            }
+            if pkg.ShortName == "main" {
+                // imported by test main
+                objects = append(objects, testObject(pkg))
+                objects = append(objects, looseObjects(testObject(pkg))...)
+            } else {
+                objects = append(objects, objectFile(pkg))
             }
-            ss.Remove(compiled)
+        } else if object := findObject(imprt); object != "" {
+            objects = append(objects, object)
         }
+    }
 
-        if ss.Len() > 0 {
-            argv = append(argv, ss.Slice()...)
-        }
+    visit(mainPKG.Name)
+
+    for i, j := 0, len(objects)-1; i < j; i, j = i+1, j-1 {
+        objects[i], objects[j] = objects[j], objects[i]
     }
 
-    if global.GetBool("-dryrun") {
-        fmt.Printf("%s || exit 1\n", strings.Join(argv, " "))
-    } else {
-        say.Println("linking  :", output)
+    return objects
+}
+
+// gccgo: main package compiled for the test main, gccgo looks
+// for pkg.gox before anything else when importing pkg
+func testObject(pkg *dag.Package) string {
+    return filepath.Join(libroot, pkg.Name) + ".gox"
+}
+
+// gccgo: main packages with tests are compiled once more (after
+// the regular compile) with a symbol prefix of their own, so that
+// the test main can import them without a clash of main.main
+func CompileMainTests(pkgs []*dag.Package) {
+
+    switch global.GetString("-backend") {
+    case "gcc", "gccgo":
+    default:
+        return
+    }
+
+    for i := 0; i < len(pkgs); i++ {
+
+        if pkgs[i].ShortName != "main" || !hasTests(pkgs[i]) {
+            continue
+        }
+
+        object := testObject(pkgs[i])
+        objdir := looseDir(object)
+        prefix := "gdtest_" +
+            strings.Replace(filepath.Dir(pkgs[i].Name), "/", "_", -1)
+
+        argv := withOutput(pkgs[i].Argv, object)
+        argv = append([]string{argv[0], "-fgo-prefix=" + prefix}, argv[1:]...)
+
+        // cgo and .s/.c files too, objects loose in objdir
+        if hasLoose(pkgs[i]) {
+
+            if global.GetBool("-dryrun") {
+                printBuild(pkgs[i], argv, object, objdir, prefix)
+                continue
+            }
+
+            say.Println("compiling:", object)
+            handy.AtExit(func() { os.Remove(object); os.RemoveAll(objdir) })
+
+            output, ok := buildPackage(pkgs[i], argv, object, objdir, prefix)
+            os.Stderr.Write(output)
+
+            if !ok {
+                log.Printf("[ERROR] failed to compile: %s\n", object)
+                handy.Exit(1)
+            }
+            continue
+        }
+
+        if global.GetBool("-dryrun") {
+            fmt.Printf("%s || exit 1\n", strings.Join(argv, " "))
+            continue
+        }
+
+        say.Println("compiling:", object)
+        handy.AtExit(func() { os.Remove(object) })
         handy.StdExecve(argv, true)
     }
 }
 
+func hasTests(pkg *dag.Package) bool {
+    for i := 0; i < len(pkg.Files); i++ {
+        if strings.HasSuffix(pkg.Files[i], "_test.go") {
+            return true
+        }
+    }
+    return false
+}
+
 func mainChoice(pkgs []*dag.Package) int {
 
     var cnt int
@@ -523,12 +1250,17 @@ func CreateTestArgv() []string {
 
 func Remove865o(dir string, alsoDir bool) {
     // override IncludeFile to make walker pick up .[865] .o .vmo
+    // (.a if dir is -lib, see RemoveArchives), the compile times
+    // recorded for -critical, generator stamps
     walker.IncludeFile = func(s string) bool {
         return strings.HasSuffix(s, ".8") ||
                strings.HasSuffix(s, ".6") ||
                strings.HasSuffix(s, ".5") ||
                strings.HasSuffix(s, ".o") ||
-               strings.HasSuffix(s, ".vmo")
+               strings.HasSuffix(s, ".vmo") ||
+               (strings.HasSuffix(s, ".a") && alsoDir) ||
+               filepath.Base(s) == ".gd-times" ||
+               filepath.Base(s) == ".gd-generate"
     }
 
     handy.DirOrExit(dir)
@@ -536,27 +1268,7 @@ func Remove865o(dir string, alsoDir bool) {
     compiled := walker.PathWalk(filepath.Clean(dir))
 
     for i := 0; i < len(compiled); i++ {
-
-        shortName := compiled[i]
-        pwd, e    := os.Getwd()
-        if e == nil {
-            if strings.HasPrefix(compiled[i], pwd){
-                shortName = shortName[len(pwd)+1:]
-            }
-        }
-
-        if !global.GetBool("-dryrun") {
-
-            e := os.Remove(compiled[i])
-            if e != nil {
-                log.Printf("[ERROR] could not delete file: %s\n", compiled[i])
-            } else {
-                say.Printf("rm: %s\n", shortName)
-            }
-
-        } else {
-            fmt.Printf("[dryrun] rm: %s\n", shortName)
-        }
+        rmCompiled(compiled[i])
     }
 
     if alsoDir {
@@ -577,6 +1289,57 @@ func Remove865o(dir string, alsoDir bool) {
     }
 }
 
+// archives of the packages in d below dir (whatever backend or -pack
+// they were built with), and the loose object dirs of main packages;
+// other files are left alone, dir may be the source tree
+func RemoveArchives(dir string, d dag.Dag) {
+
+    for _, pkg := range d {
+
+        names := make([]string, 0)
+
+        if pkg.ShortName == "main" {
+            for _, s := range []string{".5", ".6", ".8", ".o", ".vmo", ".gox"} {
+                names = append(names, looseDir(pkg.Name+s))
+            }
+        } else {
+            pkgdir, base := filepath.Split(pkg.Name)
+            names = append(names, pkg.Name+".a")
+            names = append(names, filepath.Join(pkgdir, "lib"+base+".a"))
+        }
+
+        for i := 0; i < len(names); i++ {
+            pathname := filepath.Join(dir, names[i])
+            if _, e := os.Lstat(pathname); e == nil {
+                rmCompiled(pathname)
+            }
+        }
+    }
+}
+
+func rmCompiled(pathname string) {
+
+    shortName := pathname
+    pwd, e    := os.Getwd()
+    if e == nil {
+        if strings.HasPrefix(pathname, pwd){
+            shortName = shortName[len(pwd)+1:]
+        }
+    }
+
+    if !global.GetBool("-dryrun") {
+
+        e := os.RemoveAll(pathname)
+        if e != nil {
+            log.Printf("[ERROR] could not delete file: %s\n", pathname)
+        } else {
+            say.Printf("rm: %s\n", shortName)
+        }
+
+    } else {
+        fmt.Printf("[dryrun] rm: %s\n", shortName)
+    }
+}
 
 func FormatFiles(files []string) {
 
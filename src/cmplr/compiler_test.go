@@ -0,0 +1,94 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler_test
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "cmplr/dag"
+    "cmplr/compiler"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) []string {
+
+    written := make([]string, 0)
+
+    for name, content := range files {
+        pathname := filepath.Join(root, name)
+        if e := os.MkdirAll(filepath.Dir(pathname), 0777); e != nil {
+            t.Fatalf("os.MkdirAll: %s\n", e)
+        }
+        if e := ioutil.WriteFile(pathname, []byte(content), 0755); e != nil {
+            t.Fatalf("ioutil.WriteFile: %s\n", e)
+        }
+        written = append(written, pathname)
+    }
+
+    return written
+}
+
+func TestLinkTestMain(t *testing.T) {
+
+    tmpdir, e := ioutil.TempDir("", "gdcmplr")
+
+    if e != nil {
+        t.Fatalf("ioutil.TempDir: %s\n", e)
+    }
+
+    defer os.RemoveAll(tmpdir)
+
+    // gccgo is only looked up, never run for this
+    bin := filepath.Join(tmpdir, "bin")
+    writeFiles(t, bin, map[string]string{"gccgo": "#!/bin/sh\n"})
+    os.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+    src := filepath.Join(tmpdir, "src")
+    lib := filepath.Join(tmpdir, "lib")
+
+    files := writeFiles(t, src, map[string]string{
+        "a/a.go":      "package a\n\nfunc A() int { return 1 }\n",
+        "a/a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n",
+        "b/b.go":      "package b\n\nimport \"a\"\n\nfunc B() int { return a.A() }\n",
+    })
+
+    global.SetString("-backend", "gccgo")
+    global.SetString("-lib", lib)
+
+    d := dag.New()
+    d.Parse(src, files)
+    d.GraphBuilder()
+    sorted := d.Topsort()
+
+    compiler.Init(src, "", []string{})
+    compiler.CreateLibArgv(sorted)
+
+    testMain, testDir := d.MakeMainTest(nil)
+    defer os.RemoveAll(testDir)
+
+    compiler.CreateTestMainArgv(testMain, testDir)
+
+    argv := compiler.LinkArgv(filepath.Join(tmpdir, "gdtest"), testMain, sorted)
+
+    linked := make(map[string]bool)
+
+    for i := 0; i < len(argv); i++ {
+        linked[argv[i]] = true
+    }
+
+    if !linked[filepath.Join(testDir, "main.o")] {
+        t.Fatalf("test main object not linked: %v\n", argv)
+    }
+
+    if !linked[filepath.Join(lib, "a.o")] {
+        t.Fatalf("tested package not linked: %v\n", argv)
+    }
+
+    if linked[filepath.Join(lib, "b.o")] {
+        t.Fatalf("package not imported by test main linked: %v\n", argv)
+    }
+}
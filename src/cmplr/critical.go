@@ -0,0 +1,142 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "fmt"
+    "sort"
+    "utilz/timer"
+)
+
+// The critical path is the chain of local packages (each importing
+// the next) with the largest sum of compile times; with unlimited
+// parallelism a build can not finish faster than this chain.
+
+// packages on the critical path in build order, and its length in ns
+func (d Dag) CriticalPath(times map[string]int64) ([]string, int64) {
+
+    finish := make(map[string]int64)
+    next := make(map[string]string)
+
+    var top string
+    var longest int64 = -1
+
+    names := d.names()
+
+    for i := 0; i < len(names); i++ {
+        if f := d.finish(names[i], times, finish, next); f > longest {
+            longest = f
+            top = names[i]
+        }
+    }
+
+    path := make([]string, 0)
+
+    for node := top; node != ""; node = next[node] {
+        path = append([]string{node}, path...)
+    }
+
+    return path, longest
+}
+
+// time at which name is compiled, if everything starts
+// as soon as the packages it imports are compiled
+func (d Dag) finish(name string, times, finish map[string]int64,
+next map[string]string) int64 {
+
+    if f, ok := finish[name]; ok {
+        return f
+    }
+
+    var slowest int64
+
+    deps := d[name].dependencies.Slice()
+
+    for i := 0; i < len(deps); i++ {
+        if d.localDependency(deps[i]) && deps[i] != name {
+            if f := d.finish(deps[i], times, finish, next); f > slowest {
+                slowest = f
+                next[name] = deps[i]
+            }
+        }
+    }
+
+    finish[name] = slowest + times[name]
+
+    return finish[name]
+}
+
+// print critical path, minimum build time and the packages
+// where splitting (here: halving compile time) helps most
+func (d Dag) PrintCriticalPath(times map[string]int64) {
+
+    var serial int64
+
+    for k, _ := range d {
+        serial += times[k]
+    }
+
+    path, length := d.CriticalPath(times)
+
+    fmt.Printf("critical path:\n")
+
+    for i := 0; i < len(path); i++ {
+        if t, ok := times[path[i]]; ok {
+            fmt.Printf("%14s   %s\n", timer.Nano2Time(t), path[i])
+        } else {
+            fmt.Printf("%14s   %s\n", "(no timing)", path[i])
+        }
+    }
+
+    fmt.Printf("serial build : %s\n", timer.Nano2Time(serial))
+    fmt.Printf("minimum build: %s\n", timer.Nano2Time(length))
+
+    if length > 0 {
+        fmt.Printf("max speedup  : %.1fx\n", float64(serial)/float64(length))
+    }
+
+    // try to halve each package on the path, see what is saved
+    saved := make([]int64, len(path))
+    order := make([]int, 0)
+
+    for i := 0; i < len(path); i++ {
+
+        t, ok := times[path[i]]
+
+        if !ok || t == 0 {
+            continue
+        }
+
+        times[path[i]] = t / 2
+        _, shorter := d.CriticalPath(times)
+        times[path[i]] = t
+
+        if shorter < length {
+            saved[i] = length - shorter
+            order = append(order, i)
+        }
+    }
+
+    if len(order) == 0 {
+        return
+    }
+
+    sort.Sort(bySaved{order, saved})
+
+    fmt.Printf("split candidates (saved by halving):\n")
+
+    for i := 0; i < len(order) && i < 3; i++ {
+        fmt.Printf("%14s   %s\n", timer.Nano2Time(saved[order[i]]), path[order[i]])
+    }
+}
+
+type bySaved struct {
+    order []int
+    saved []int64
+}
+
+func (b bySaved) Len() int           { return len(b.order) }
+func (b bySaved) Less(i, j int) bool { return b.saved[b.order[i]] > b.saved[b.order[j]] }
+func (b bySaved) Swap(i, j int)      { b.order[i], b.order[j] = b.order[j], b.order[i] }
@@ -11,8 +11,11 @@ import (
     "go/ast"
     "os"
     "fmt"
-    "time"
+    "io/ioutil"
+    "crypto/sha1"
+    "encoding/hex"
     "log"
+    "sort"
     "strings"
     "regexp"
     "path/filepath"
@@ -21,6 +24,7 @@ import (
     "utilz/handy"
     "utilz/global"
     "utilz/say"
+    "parse/rules"
 )
 
 
@@ -31,14 +35,25 @@ type Package struct {
     Name, ShortName string   // absolute path, basename
     Argv            []string // command needed to compile package
     Files           []string // relative path of files
+    CgoFiles        []string // files (also in Files) which import "C"
+    Sources         []string // .s and .c files
     dependencies    *stringset.StringSet
     children        []*Package // packages that depend on this
+    locations       map[string][]string // import -> file:line
 }
 
 type TestCollector struct {
     Names []string
 }
 
+// import statement of a single file
+type importSpec struct {
+    Path, Name, Location string
+}
+
+// shared by all parsed files, so import positions can be reported
+var fileSet = token.NewFileSet()
+
 func New() Dag {
     return make(map[string]*Package)
 }
@@ -47,8 +62,11 @@ func newPackage() *Package {
     p := new(Package)
     p.Indegree = 0
     p.Files = make([]string, 0)
+    p.CgoFiles = make([]string, 0)
+    p.Sources = make([]string, 0)
     p.dependencies = stringset.New()
     p.children = make([]*Package, 0)
+    p.locations = make(map[string][]string)
     return p
 }
 
@@ -89,7 +107,50 @@ func (d Dag) Parse(root string, files []string) {
         }
 
         ast.Walk(d[pkgname], tree)
+        d[pkgname].addLocations(tree)
         d[pkgname].Files = append(d[pkgname].Files, e)
+
+        if importsC(tree) {
+            d[pkgname].CgoFiles = append(d[pkgname].CgoFiles, e)
+        }
+    }
+}
+
+// .s and .c files belong to the package in their directory,
+// (external) _test packages are not considered
+func (d Dag) AddSources(files []string) {
+
+    byDir := make(map[string][]*Package)
+
+    for _, k := range d.names() {
+
+        p := d[k]
+
+        if strings.HasSuffix(p.ShortName, "_test") {
+            continue
+        }
+
+        dirs := stringset.New()
+
+        for i := 0; i < len(p.Files); i++ {
+            dirs.Add(filepath.Dir(p.Files[i]))
+        }
+
+        for dir := range dirs.Iter() {
+            byDir[dir] = append(byDir[dir], p)
+        }
+    }
+
+    for i := 0; i < len(files); i++ {
+        pkgs := byDir[filepath.Dir(files[i])]
+        switch len(pkgs) {
+        case 0:
+            log.Printf("[WARNING] %s: no package in directory\n", files[i])
+        case 1:
+            pkgs[0].Sources = append(pkgs[0].Sources, files[i])
+        default:
+            log.Printf("[WARNING] %s: more than one package in directory\n", files[i])
+        }
     }
 }
 
@@ -100,11 +161,13 @@ func (d Dag) addEdge(from, to string) {
     toNode.Indegree++
 }
 // note that nothing is done in order to check if dependencies
-// are valid if they are not part of the actual source-tree.
+// are valid if they are not part of the actual source-tree,
+// see MissingImports for that.
 
 func (d Dag) GraphBuilder() {
 
-    for k, v := range d {
+    for _, k := range d.names() {
+        v := d[k]
         for dep := range v.dependencies.Iter() {
             if d.localDependency(dep) {
                 d.addEdge(dep, k)
@@ -114,6 +177,78 @@ func (d Dag) GraphBuilder() {
     }
 }
 
+// Report every local edge (import) which violates one of the
+// rules, returns false if any were found.
+func (d Dag) CheckLayers(rs []*rules.Rule) bool {
+
+    var ok bool = true
+
+    for _, k := range d.names() {
+        v := d[k]
+        for dep := range v.dependencies.Iter() {
+            if d.localDependency(dep) {
+                if r := rules.Check(rs, k, dep); r != nil {
+                    ok = false
+                    for _, location := range v.locations[dep] {
+                        log.Printf("[ERROR] %s: %s imports %s, violates %s\n",
+                            location, k, dep, r)
+                    }
+                }
+            }
+        }
+    }
+
+    return ok
+}
+
+// Returns imports (-> file:line) which are neither part of the
+// source-tree nor found as a compiled package in one of the
+// directories given, i.e. dir/import + suffix must exist.
+func (d Dag) MissingImports(dirs, suffixes []string) map[string][]string {
+
+    missing := make(map[string][]string)
+
+    for _, k := range d.names() {
+        v := d[k]
+        for dep := range v.dependencies.Iter() {
+            if d.localDependency(dep) || pseudoPackage(dep) {
+                continue
+            }
+            if !compiledPackage(dep, dirs, suffixes) {
+                missing[dep] = append(missing[dep], v.locations[dep]...)
+            }
+        }
+    }
+
+    return missing
+}
+
+func compiledPackage(imprt string, dirs, suffixes []string) bool {
+
+    dir, base := filepath.Split(imprt)
+
+    for i := 0; i < len(dirs); i++ {
+        for j := 0; j < len(suffixes); j++ {
+            fileinfo, e := os.Stat(filepath.Join(dirs[i], imprt) + suffixes[j])
+            if e == nil && fileinfo.IsRegular() {
+                return true
+            }
+        }
+        // gccgo archive
+        fileinfo, e := os.Stat(filepath.Join(dirs[i], dir, "lib"+base+".a"))
+        if e == nil && fileinfo.IsRegular() {
+            return true
+        }
+    }
+
+    return false
+}
+
+// packages handled by the compiler itself (or cgo)
+func pseudoPackage(imprt string) bool {
+    return imprt == "unsafe" || imprt == "C"
+}
+
 func (d Dag) External() {
 
     var err os.Error
@@ -218,9 +353,7 @@ func (d Dag) MakeDotGraph(filename string) {
 
     sb.Add("digraph depgraph {\n\trankdir=LR;\n")
 
-    for _, v := range d {
-        v.DotGraph(sb)
-    }
+    d.dotBody(sb)
 
     sb.Add("}\n")
 
@@ -230,9 +363,11 @@ func (d Dag) MakeDotGraph(filename string) {
 
 }
 
-func (d Dag) MakeMainTest(root string) ([]*Package, string) {
+// only tests of packages in only are included, all if only is nil,
+// the caller must remove the returned directory (work directory)
+func (d Dag) MakeMainTest(only []string) ([]*Package, string) {
 
-    var max, i int
+    var max, i, mains int
     var isTest bool
     var sname, tmpdir, tmpstub, tmpfile string
 
@@ -249,12 +384,34 @@ func (d Dag) MakeMainTest(root string) ([]*Package, string) {
     sbTests.Add("\n\nvar tests = []testing.InternalTest{\n")
     sbBench.Add("\n\nvar benchmarks = []testing.InternalBenchmark{\n")
 
-    for _, v := range d {
+    onlySet := stringset.New()
+
+    for i = 0; i < len(only); i++ {
+        onlySet.Add(only[i])
+    }
+
+    for _, k := range d.names() {
+
+        v := d[k]
+
+        if only != nil && !onlySet.Contains(v.Name) {
+            continue
+        }
 
         isTest = false
         sname = v.ShortName
         max = len(v.ShortName)
 
+        // a package main can not be imported as 'main' into package main
+        qualifier := sname
+        imprt := fmt.Sprintf("import \"%s\"\n", v.Name)
+
+        if sname == "main" {
+            mains++
+            qualifier = fmt.Sprintf("main%d", mains)
+            imprt = fmt.Sprintf("import %s \"%s\"\n", qualifier, v.Name)
+        }
+
         if max > 5 && sname[max-5:] == "_test" {
             collector := newTestCollector()
             for i = 0; i < len(v.Files); i++ {
@@ -264,15 +421,15 @@ func (d Dag) MakeMainTest(root string) ([]*Package, string) {
 
             if len(collector.Names) > 0 {
                 isTest = true
-                imprtSet.Add(fmt.Sprintf("import \"%s\"\n", v.Name))
+                imprtSet.Add(imprt)
                 for i = 0; i < len(collector.Names); i++ {
                     testFunc := collector.Names[i]
                     if len(testFunc) >= 4 && testFunc[0:4] == "Test" {
                         sbTests.Add(fmt.Sprintf("testing.InternalTest{\"%s.%s\", %s.%s },\n",
-                            sname, testFunc, sname, testFunc))
+                            sname, testFunc, qualifier, testFunc))
                     } else if len(testFunc) >= 9 && testFunc[0:9] == "Benchmark" {
                         sbBench.Add(fmt.Sprintf("testing.InternalBenchmark{\"%s.%s\", %s.%s },\n",
-                            sname, testFunc, sname, testFunc))
+                            sname, testFunc, qualifier, testFunc))
 
                     }
                 }
@@ -292,15 +449,15 @@ func (d Dag) MakeMainTest(root string) ([]*Package, string) {
             }
 
             if len(collector.Names) > 0 {
-                imprtSet.Add(fmt.Sprintf("import \"%s\"\n", v.Name))
+                imprtSet.Add(imprt)
                 for i = 0; i < len(collector.Names); i++ {
                     testFunc := collector.Names[i]
                     if len(testFunc) >= 4 && testFunc[0:4] == "Test" {
                         sbTests.Add(fmt.Sprintf("testing.InternalTest{\"%s.%s\", %s.%s },\n",
-                            sname, testFunc, sname, testFunc))
+                            sname, testFunc, qualifier, testFunc))
                     } else if len(testFunc) >= 9 && testFunc[0:9] == "Benchmark" {
                         sbBench.Add(fmt.Sprintf("testing.InternalBenchmark{\"%s.%s\", %s.%s },\n",
-                            sname, testFunc, sname, testFunc))
+                            sname, testFunc, qualifier, testFunc))
                     }
                 }
             }
@@ -324,20 +481,32 @@ func (d Dag) MakeMainTest(root string) ([]*Package, string) {
     sbTotal.Add("func main(){\n")
     sbTotal.Add("testing.Main(regexp.MatchString, tests, benchmarks);\n}\n\n")
 
-    tmpstub = fmt.Sprintf("tmp%d", time.Seconds())
-    tmpdir = fmt.Sprintf("%s%s", addSeparatorPath(root), tmpstub)
-
-    dir, e1 := os.Stat(tmpdir)
-
-    if e1 == nil && dir.IsDirectory() {
-        log.Printf("[ERROR] directory: %s already exists\n", tmpdir)
+    // outside the source tree, so that leftovers are never
+    // mistaken for a package, unique so that runs don't collide;
+    // -reproducible: path ends up in objects, keep it stable for
+    // the project (its packages), reused by whoever holds its lock
+    if global.GetBool("-reproducible") {
+        h := sha1.New()
+        for _, name := range d.names() {
+            fmt.Fprintf(h, "%s\n", name)
+        }
+        stamp := hex.EncodeToString(h.Sum())[:12]
+        tmpdir = filepath.Join(os.TempDir(), "gdtest-"+stamp)
+        lockDir(tmpdir)
+        os.RemoveAll(tmpdir) // left behind by a killed run
+        if e := os.Mkdir(tmpdir, 0777); e != nil {
+            log.Fatalf("[ERROR] %s\n", e)
+        }
     } else {
-        e_mk := os.Mkdir(tmpdir, 0777)
-        if e_mk != nil {
-            log.Fatal("[ERROR] failed to create directory for testing")
+        var e os.Error
+        tmpdir, e = ioutil.TempDir("", "gdtest")
+        if e != nil {
+            log.Fatalf("[ERROR] %s\n", e)
         }
     }
 
+    tmpstub = filepath.Base(tmpdir)
+
     tmpfile = filepath.Join(tmpdir, "_main.go")
 
     fil, e2 := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE, 0777)
@@ -361,11 +530,47 @@ func (d Dag) MakeMainTest(root string) ([]*Package, string) {
     p.ShortName = "main"
     p.Files = append(p.Files, tmpfile)
 
+    // the tested packages, as any other package would import them
+    tree := getSyntaxTreeOrDie(tmpfile, parser.ImportsOnly)
+    ast.Walk(p, tree)
+    p.addLocations(tree)
+
     vec := make([]*Package, 1)
     vec[0] = p
     return vec, tmpdir
 }
 
+// dir.lock holds the pid of its owner, a lock whose owner is gone
+// (no /proc/pid) is taken over; released when gd exits
+func lockDir(dir string) {
+
+    lockfile := dir + ".lock"
+
+    for attempt := 0; attempt < 2; attempt++ {
+
+        fil, e := os.OpenFile(lockfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+        if e == nil {
+            fmt.Fprintf(fil, "%d\n", os.Getpid())
+            fil.Close()
+            handy.AtExit(func() { os.Remove(lockfile) })
+            return
+        }
+
+        b, _ := ioutil.ReadFile(lockfile)
+        pid := strings.TrimSpace(string(b))
+
+        if pid != "" && (!handy.IsDir("/proc/self") || handy.IsDir("/proc/"+pid)) {
+            log.Fatalf("[ERROR] %s: in use by process %s (remove it if that is not gd)\n",
+                dir, pid)
+        }
+
+        os.Remove(lockfile) // stale
+    }
+
+    log.Fatalf("[ERROR] could not lock: %s\n", dir)
+}
+
 func (d Dag) Topsort() []*Package {
 
     var node, child *Package
@@ -374,12 +579,13 @@ func (d Dag) Topsort() []*Package {
     zero := make([]*Package, 0)
     done := make([]*Package, 0)
 
-    for _, v := range d {
-        if v.Indegree == 0 {
-            zero = append(zero, v)
+    for _, k := range d.names() {
+        if d[k].Indegree == 0 {
+            zero = append(zero, d[k])
         }
     }
 
+    // ties are broken by name, i.e. zero is kept sorted
     for len(zero) > 0 {
 
         node = zero[0]
@@ -392,6 +598,9 @@ func (d Dag) Topsort() []*Package {
                 zero = append(zero, child)
             }
         }
+
+        sort.Sort(byName(zero))
+
         cnt++
         done = append(done, node)
     }
@@ -403,6 +612,22 @@ func (d Dag) Topsort() []*Package {
     return done
 }
 
+// package names, sorted
+func (d Dag) names() []string {
+    names := make([]string, 0, len(d))
+    for k, _ := range d {
+        names = append(names, k)
+    }
+    sort.SortStrings(names)
+    return names
+}
+
+type byName []*Package
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
 func (d Dag) localDependency(dep string) bool {
     _, ok := d[dep]
     return ok
@@ -417,7 +642,8 @@ func (d Dag) PrintInfo() {
     fmt.Println("p = package, f = file, d = dependency ")
     fmt.Println("--------------------------------------\n")
 
-    for k, v := range d {
+    for _, k := range d.names() {
+        v := d[k]
         fmt.Println("p ", k)
         for i = 0; i < len(v.Files); i++ {
             fmt.Println("f ", v.Files[i])
@@ -429,21 +655,6 @@ func (d Dag) PrintInfo() {
     }
 }
 
-func (p *Package) DotGraph(sb *stringbuffer.StringBuffer) {
-
-    if p.dependencies.Len() == 0 {
-
-        sb.Add(fmt.Sprintf("\t\"%s\";\n", p.Name))
-
-    } else {
-
-        for dep := range p.dependencies.Iter() {
-            sb.Add(fmt.Sprintf("\t\"%s\" -> \"%s\";\n", p.Name, dep))
-        }
-    }
-}
-
-
 func (p *Package) UpToDate() bool {
 
     if p.Argv == nil {
@@ -479,9 +690,22 @@ func (p *Package) UpToDate() bool {
         }
     }
 
+    // .s and .c files are packed into the same archive
+    for i = 0; i < len(p.Sources); i++ {
+        finfo, e = os.Stat(p.Sources[i])
+        if e != nil || finfo.Mtime_ns > compiledModifiedTime {
+            return false
+        }
+    }
+
     return true
 }
 
+// imports of package, sorted
+func (p *Package) Dependencies() []string {
+    return p.dependencies.Slice()
+}
+
 func (p *Package) Ready(local, compiled *stringset.StringSet) bool {
 
     for dep := range p.dependencies.Iter() {
@@ -513,6 +737,56 @@ func (p *Package) Visit(node ast.Node) (v ast.Visitor) {
     return p
 }
 
+func (p *Package) addLocations(tree *ast.File) {
+    specs := fileImports(tree)
+    for i := 0; i < len(specs); i++ {
+        p.locations[specs[i].Path] = append(p.locations[specs[i].Path],
+            specs[i].Location)
+    }
+}
+
+func importsC(tree *ast.File) bool {
+    specs := fileImports(tree)
+    for i := 0; i < len(specs); i++ {
+        if specs[i].Path == "C" {
+            return true
+        }
+    }
+    return false
+}
+
+// package needs cgo
+func (p *Package) Cgo() bool {
+    return len(p.CgoFiles) > 0
+}
+
+func fileImports(tree *ast.File) []*importSpec {
+
+    specs := make([]*importSpec, 0)
+
+    for _, decl := range tree.Decls {
+        gdecl, ok := decl.(*ast.GenDecl)
+        if !ok || gdecl.Tok != token.IMPORT {
+            continue
+        }
+        for _, spec := range gdecl.Specs {
+            ispec, ok := spec.(*ast.ImportSpec)
+            if ok {
+                s := new(importSpec)
+                s.Path = string(ispec.Path.Value[1 : len(ispec.Path.Value)-1])
+                if ispec.Name != nil {
+                    s.Name = ispec.Name.Name
+                }
+                pos := fileSet.Position(ispec.Path.Pos())
+                s.Location = fmt.Sprintf("%s:%d", pos.Filename, pos.Line)
+                specs = append(specs, s)
+            }
+        }
+    }
+
+    return specs
+}
+
 func (t *TestCollector) Visit(node ast.Node) (v ast.Visitor) {
     switch node.(type) {
     case *ast.FuncDecl:
@@ -533,7 +807,7 @@ func addSeparatorPath(root string) string {
 }
 
 func getSyntaxTreeOrDie(file string, mode uint) *ast.File {
-    absSynTree, err := parser.ParseFile(token.NewFileSet(), file, nil, mode)
+    absSynTree, err := parser.ParseFile(fileSet, file, nil, mode)
     if err != nil {
         log.Fatalf("%s\n", err)
     }
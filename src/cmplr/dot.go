@@ -0,0 +1,329 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "path"
+    "sort"
+    "bytes"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "utilz/stringset"
+    "utilz/stringbuffer"
+    "utilz/global"
+)
+
+// graphviz output is shaped by these options:
+//
+//  -dot-nostd     hide standard library packages
+//  -dot-noext     hide external (remote) packages
+//  -dot-cluster   cluster local packages by directory
+//  -dot-color     colour main/test/library/stdlib/external
+//  -dot-label     annotate local packages: 'files' or 'lines'
+//  -dot-reduce    draw the transitive reduction only
+//  -dot-focus     only draw the neighbourhood of this package
+//  -dot-depth     size of the neighbourhood (default: 1)
+
+const (
+    localKind = iota
+    stdKind
+    externalKind
+)
+
+func (d Dag) kind(name string) int {
+    if d.localDependency(name) {
+        return localKind
+    }
+    if seemsExternal(name) ||
+        strings.Contains(strings.Split(name, "/", 2)[0], ".") {
+        return externalKind
+    }
+    return stdKind
+}
+
+// package -> imports that should be drawn
+func (d Dag) dotEdges() map[string][]string {
+
+    edges := make(map[string][]string)
+
+    for k, v := range d {
+        edges[k] = make([]string, 0)
+        for dep := range v.dependencies.Iter() {
+            switch d.kind(dep) {
+            case stdKind:
+                if global.GetBool("-dot-nostd") {
+                    continue
+                }
+            case externalKind:
+                if global.GetBool("-dot-noext") {
+                    continue
+                }
+            }
+            edges[k] = append(edges[k], dep)
+        }
+        sort.SortStrings(edges[k])
+    }
+
+    if global.GetBool("-dot-reduce") {
+        edges = reduce(edges)
+    }
+
+    if global.GetString("-dot-focus") != "" {
+        edges = d.focus(edges)
+    }
+
+    return edges
+}
+
+// remove a -> c if c can be reached through another import of a
+func reduce(edges map[string][]string) map[string][]string {
+
+    reduced := make(map[string][]string)
+
+    for from, tos := range edges {
+        reduced[from] = make([]string, 0)
+        for i := 0; i < len(tos); i++ {
+            redundant := false
+            for j := 0; j < len(tos) && !redundant; j++ {
+                if i != j && reachable(edges, tos[j], tos[i]) {
+                    redundant = true
+                }
+            }
+            if !redundant {
+                reduced[from] = append(reduced[from], tos[i])
+            }
+        }
+    }
+
+    return reduced
+}
+
+func reachable(edges map[string][]string, from, to string) bool {
+
+    seen := stringset.New()
+    stack := []string{from}
+
+    for len(stack) > 0 {
+        node := stack[len(stack)-1]
+        stack = stack[:len(stack)-1]
+        if node == to {
+            return true
+        }
+        if seen.Add(node) {
+            stack = append(stack, edges[node]...)
+        }
+    }
+
+    return false
+}
+
+// keep edges between packages at most -dot-depth
+// imports away (either direction) from -dot-focus
+func (d Dag) focus(edges map[string][]string) map[string][]string {
+
+    var depth int = 1
+    var e os.Error
+
+    center := global.GetString("-dot-focus")
+
+    if !d.localDependency(center) {
+        log.Fatalf("[ERROR] -dot-focus: unknown package: %s\n", center)
+    }
+
+    if global.GetString("-dot-depth") != "" {
+        depth, e = strconv.Atoi(global.GetString("-dot-depth"))
+        if e != nil || depth < 0 {
+            log.Fatalf("[ERROR] -dot-depth: %s\n", global.GetString("-dot-depth"))
+        }
+    }
+
+    neighbours := make(map[string][]string)
+
+    for from, tos := range edges {
+        for i := 0; i < len(tos); i++ {
+            neighbours[from] = append(neighbours[from], tos[i])
+            neighbours[tos[i]] = append(neighbours[tos[i]], from)
+        }
+    }
+
+    near := stringset.New()
+    near.Add(center)
+    current := []string{center}
+
+    for i := 0; i < depth; i++ {
+        next := make([]string, 0)
+        for j := 0; j < len(current); j++ {
+            nbs := neighbours[current[j]]
+            for k := 0; k < len(nbs); k++ {
+                if near.Add(nbs[k]) {
+                    next = append(next, nbs[k])
+                }
+            }
+        }
+        current = next
+    }
+
+    focused := make(map[string][]string)
+
+    for from, tos := range edges {
+        if !near.Contains(from) {
+            continue
+        }
+        focused[from] = make([]string, 0)
+        for i := 0; i < len(tos); i++ {
+            if near.Contains(tos[i]) {
+                focused[from] = append(focused[from], tos[i])
+            }
+        }
+    }
+
+    return focused
+}
+
+func (d Dag) dotBody(sb *stringbuffer.StringBuffer) {
+
+    edges := d.dotEdges()
+
+    locals := make([]string, 0)
+    others := stringset.New()
+
+    for from, tos := range edges {
+        locals = append(locals, from)
+        for i := 0; i < len(tos); i++ {
+            if !d.localDependency(tos[i]) {
+                others.Add(tos[i])
+            }
+        }
+    }
+
+    sort.SortStrings(locals)
+
+    if global.GetBool("-dot-cluster") {
+
+        clusters := make(map[string][]string)
+        dirs := make([]string, 0)
+
+        for i := 0; i < len(locals); i++ {
+            dir := path.Dir(locals[i])
+            if _, ok := clusters[dir]; !ok {
+                dirs = append(dirs, dir)
+            }
+            clusters[dir] = append(clusters[dir], locals[i])
+        }
+
+        sort.SortStrings(dirs)
+
+        for i := 0; i < len(dirs); i++ {
+            sb.Add(fmt.Sprintf("\tsubgraph \"cluster_%s\" {\n", dirs[i]))
+            sb.Add(fmt.Sprintf("\t\tlabel=\"%s\";\n", dirs[i]))
+            for j := 0; j < len(clusters[dirs[i]]); j++ {
+                sb.Add("\t" + d.dotNode(clusters[dirs[i]][j]))
+            }
+            sb.Add("\t}\n")
+        }
+
+    } else {
+        for i := 0; i < len(locals); i++ {
+            sb.Add(d.dotNode(locals[i]))
+        }
+    }
+
+    othersSlice := others.Slice()
+    sort.SortStrings(othersSlice)
+
+    for i := 0; i < len(othersSlice); i++ {
+        sb.Add(d.dotNode(othersSlice[i]))
+    }
+
+    for i := 0; i < len(locals); i++ {
+        tos := edges[locals[i]]
+        for j := 0; j < len(tos); j++ {
+            sb.Add(fmt.Sprintf("\t\"%s\" -> \"%s\";\n", locals[i], tos[j]))
+        }
+    }
+}
+
+func (d Dag) dotNode(name string) string {
+
+    attrs := make([]string, 0)
+    label := name
+
+    if p, ok := d[name]; ok {
+        switch global.GetString("-dot-label") {
+        case "":
+        case "files":
+            label = fmt.Sprintf("%s\\n%d files", name, len(p.Files))
+        case "lines":
+            label = fmt.Sprintf("%s\\n%d lines", name, p.lines())
+        default:
+            log.Fatalf("[ERROR] -dot-label: '%s' not in [files,lines]\n",
+                global.GetString("-dot-label"))
+        }
+    }
+
+    if label != name {
+        attrs = append(attrs, fmt.Sprintf("label=\"%s\"", label))
+    }
+
+    if global.GetBool("-dot-color") {
+        attrs = append(attrs, "style=filled")
+        attrs = append(attrs, fmt.Sprintf("fillcolor=\"%s\"", d.dotColor(name)))
+    }
+
+    if len(attrs) == 0 {
+        return fmt.Sprintf("\t\"%s\";\n", name)
+    }
+
+    return fmt.Sprintf("\t\"%s\" [%s];\n", name, strings.Join(attrs, ","))
+}
+
+func (d Dag) dotColor(name string) string {
+
+    switch d.kind(name) {
+    case stdKind:
+        return "lightgrey"
+    case externalKind:
+        return "orange"
+    }
+
+    p := d[name]
+
+    if p.ShortName == "main" {
+        return "salmon"
+    } else if strings.HasSuffix(p.ShortName, "_test") || p.hasTestFiles() {
+        return "lightblue"
+    }
+
+    return "palegreen"
+}
+
+func (p *Package) hasTestFiles() bool {
+    for i := 0; i < len(p.Files); i++ {
+        if strings.HasSuffix(p.Files[i], "_test.go") {
+            return true
+        }
+    }
+    return false
+}
+
+// number of lines in all files of package
+func (p *Package) lines() int {
+
+    var total int
+
+    for i := 0; i < len(p.Files); i++ {
+        b, e := ioutil.ReadFile(p.Files[i])
+        if e != nil {
+            log.Fatalf("[ERROR] %s\n", e)
+        }
+        total += bytes.Count(b, []byte("\n"))
+    }
+
+    return total
+}
@@ -0,0 +1,460 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "json"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/stringset"
+    "utilz/stringbuffer"
+)
+
+// Export the package graph in a format other than graphviz dot,
+// the same -dot-* filters are applied to what gets exported.
+//
+//  graphml  :  GraphML (xml) for yEd, Gephi ..
+//  json     :  adjacency list
+//  mermaid  :  mermaid flowchart (in a ```mermaid fence for .md)
+//  html     :  self contained page with an interactive svg
+//  svg      :  the same drawing, standalone (not interactive)
+//
+// If format is empty it is guessed from the filename suffix.
+func (d Dag) MakeGraph(filename, format string) {
+
+    if format == "" {
+        format = formatFromName(filename)
+    }
+
+    nodes, edges := d.graphNodesEdges()
+
+    var content string
+
+    switch format {
+    case "graphml":
+        content = d.graphML(nodes, edges)
+    case "json":
+        content = d.graphJSON(nodes, edges)
+    case "mermaid":
+        content = d.graphMermaid(nodes, edges)
+        if strings.ToLower(filepath.Ext(filename)) == ".md" {
+            content = "```mermaid\n" + content + "```\n"
+        }
+    case "html":
+        content = d.graphHTML(nodes, edges)
+    case "svg":
+        content = d.graphSVG(nodes, edges)
+    default:
+        log.Fatalf("[ERROR] unknown graph format: '%s' "+
+            "[graphml,json,mermaid,html,svg]\n", format)
+    }
+
+    e := ioutil.WriteFile(filename, []byte(content), 0644)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+}
+
+func formatFromName(filename string) string {
+
+    switch strings.ToLower(filepath.Ext(filename)) {
+    case ".graphml", ".xml":
+        return "graphml"
+    case ".json":
+        return "json"
+    case ".mmd", ".mermaid", ".md":
+        return "mermaid"
+    case ".html", ".htm":
+        return "html"
+    case ".svg":
+        return "svg"
+    }
+
+    log.Fatalf("[ERROR] cannot guess graph format from: %s\n", filename)
+    return ""
+}
+
+// all nodes (sorted) and edges after -dot-* filters
+func (d Dag) graphNodesEdges() ([]string, map[string][]string) {
+
+    edges := d.dotEdges()
+    set := stringset.New()
+
+    for from, tos := range edges {
+        set.Add(from)
+        for i := 0; i < len(tos); i++ {
+            set.Add(tos[i])
+        }
+    }
+
+    nodes := set.Slice()
+    sort.SortStrings(nodes)
+
+    return nodes, edges
+}
+
+func (d Dag) kindName(name string) string {
+    switch d.kind(name) {
+    case stdKind:
+        return "stdlib"
+    case externalKind:
+        return "external"
+    }
+    if d[name].ShortName == "main" {
+        return "main"
+    } else if strings.HasSuffix(d[name].ShortName, "_test") ||
+        d[name].hasTestFiles() {
+        return "test"
+    }
+    return "library"
+}
+
+func (d Dag) fileCount(name string) int {
+    if p, ok := d[name]; ok {
+        return len(p.Files)
+    }
+    return 0
+}
+
+func xmlEscape(s string) string {
+    s = strings.Replace(s, "&", "&amp;", -1)
+    s = strings.Replace(s, "<", "&lt;", -1)
+    s = strings.Replace(s, ">", "&gt;", -1)
+    s = strings.Replace(s, "\"", "&quot;", -1)
+    return s
+}
+
+func jsonString(s string) string {
+    b, e := json.Marshal(s)
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+    return string(b)
+}
+
+func (d Dag) graphML(nodes []string, edges map[string][]string) string {
+
+    sb := stringbuffer.NewSize(1000)
+
+    sb.Add("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+    sb.Add("<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+    sb.Add("  <key id=\"kind\" for=\"node\" attr.name=\"kind\" attr.type=\"string\"/>\n")
+    sb.Add("  <key id=\"files\" for=\"node\" attr.name=\"files\" attr.type=\"int\"/>\n")
+    sb.Add("  <graph id=\"depgraph\" edgedefault=\"directed\">\n")
+
+    for i := 0; i < len(nodes); i++ {
+        sb.Add(fmt.Sprintf("    <node id=\"%s\">", xmlEscape(nodes[i])))
+        sb.Add(fmt.Sprintf("<data key=\"kind\">%s</data>", d.kindName(nodes[i])))
+        sb.Add(fmt.Sprintf("<data key=\"files\">%d</data>", d.fileCount(nodes[i])))
+        sb.Add("</node>\n")
+    }
+
+    for i := 0; i < len(nodes); i++ {
+        tos := edges[nodes[i]]
+        for j := 0; j < len(tos); j++ {
+            sb.Add(fmt.Sprintf("    <edge source=\"%s\" target=\"%s\"/>\n",
+                xmlEscape(nodes[i]), xmlEscape(tos[j])))
+        }
+    }
+
+    sb.Add("  </graph>\n</graphml>\n")
+
+    return sb.String()
+}
+
+func (d Dag) graphJSON(nodes []string, edges map[string][]string) string {
+
+    sb := stringbuffer.NewSize(1000)
+
+    sb.Add("{\n  \"packages\": [\n")
+
+    for i := 0; i < len(nodes); i++ {
+
+        tos := edges[nodes[i]]
+        quoted := make([]string, len(tos))
+
+        for j := 0; j < len(tos); j++ {
+            quoted[j] = jsonString(tos[j])
+        }
+
+        sb.Add(fmt.Sprintf("    {\"name\": %s, \"kind\": \"%s\", \"files\": %d, \"imports\": [%s]}",
+            jsonString(nodes[i]), d.kindName(nodes[i]),
+            d.fileCount(nodes[i]), strings.Join(quoted, ", ")))
+
+        if i < len(nodes)-1 {
+            sb.Add(",")
+        }
+        sb.Add("\n")
+    }
+
+    sb.Add("  ]\n}\n")
+
+    return sb.String()
+}
+
+func (d Dag) graphMermaid(nodes []string, edges map[string][]string) string {
+
+    ids := make(map[string]string)
+    sb := stringbuffer.NewSize(1000)
+
+    sb.Add("graph LR\n")
+
+    for i := 0; i < len(nodes); i++ {
+        ids[nodes[i]] = fmt.Sprintf("n%d", i)
+        sb.Add(fmt.Sprintf("    n%d[\"%s\"]:::%s\n", i, nodes[i], d.kindName(nodes[i])))
+    }
+
+    for i := 0; i < len(nodes); i++ {
+        tos := edges[nodes[i]]
+        for j := 0; j < len(tos); j++ {
+            sb.Add(fmt.Sprintf("    %s --> %s\n", ids[nodes[i]], ids[tos[j]]))
+        }
+    }
+
+    sb.Add("    classDef main fill:#fa8072\n")
+    sb.Add("    classDef test fill:#add8e6\n")
+    sb.Add("    classDef library fill:#98fb98\n")
+    sb.Add("    classDef stdlib fill:#d3d3d3\n")
+    sb.Add("    classDef external fill:#ffa500\n")
+
+    return sb.String()
+}
+
+// column of a node: packages without imports to the right,
+// every other package left of everything it imports
+func columns(nodes []string, edges map[string][]string) map[string]int {
+
+    column := make(map[string]int)
+    visiting := stringset.New()
+
+    var visit func(string) int
+
+    visit = func(node string) int {
+        if c, ok := column[node]; ok {
+            return c
+        }
+        if !visiting.Add(node) {
+            return 0 // loop, Topsort will complain elsewhere
+        }
+        max := 0
+        tos := edges[node]
+        for i := 0; i < len(tos); i++ {
+            if c := visit(tos[i]) + 1; c > max {
+                max = c
+            }
+        }
+        column[node] = max
+        return max
+    }
+
+    for i := 0; i < len(nodes); i++ {
+        visit(nodes[i])
+    }
+
+    return column
+}
+
+// the svg drawing of the graph (standalone: sized in pixels, with
+// its own styles) and the imports of each node for the script
+func (d Dag) drawing(nodes []string, edges map[string][]string, standalone bool) (string, []string) {
+
+    const (
+        colWidth  = 260
+        rowHeight = 40
+        boxHeight = 24
+        margin    = 20
+    )
+
+    column := columns(nodes, edges)
+    maxColumn := 0
+
+    for i := 0; i < len(nodes); i++ {
+        if column[nodes[i]] > maxColumn {
+            maxColumn = column[nodes[i]]
+        }
+    }
+
+    rows := make(map[int]int)
+    xs := make(map[string]int)
+    ys := make(map[string]int)
+    ws := make(map[string]int)
+    maxRow := 0
+
+    for i := 0; i < len(nodes); i++ {
+        c := column[nodes[i]]
+        xs[nodes[i]] = margin + (maxColumn-c)*colWidth
+        ys[nodes[i]] = margin + rows[c]*rowHeight
+        ws[nodes[i]] = len(nodes[i])*7 + 16
+        rows[c]++
+        if rows[c] > maxRow {
+            maxRow = rows[c]
+        }
+    }
+
+    width := (maxColumn+1)*colWidth + 2*margin
+    height := maxRow*rowHeight + 2*margin
+
+    colors := map[string]string{
+        "main":     "#fa8072",
+        "test":     "#add8e6",
+        "library":  "#98fb98",
+        "stdlib":   "#d3d3d3",
+        "external": "#ffa500",
+    }
+
+    svg := stringbuffer.NewSize(5000)
+    adjacency := make([]string, 0)
+
+    if standalone {
+        svg.Add(fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" "+
+            "viewBox=\"0 0 %d %d\" width=\"%d\" height=\"%d\">\n",
+            width, height, width, height))
+        svg.Add("<style>\n" +
+            "  text { font-family: monospace; font-size: 12px; }\n" +
+            "  rect { stroke: #333; }\n" +
+            "  line { stroke: #999; stroke-width: 1; }\n" +
+            "</style>\n")
+    } else {
+        svg.Add(fmt.Sprintf("<svg id=\"graph\" xmlns=\"http://www.w3.org/2000/svg\" "+
+            "viewBox=\"0 0 %d %d\" width=\"100%%\" height=\"95%%\">\n", width, height))
+    }
+    svg.Add("<defs><marker id=\"arrow\" viewBox=\"0 0 10 10\" refX=\"10\" refY=\"5\" " +
+        "markerWidth=\"6\" markerHeight=\"6\" orient=\"auto\">" +
+        "<path d=\"M0,0 L10,5 L0,10 z\"/></marker></defs>\n")
+
+    for i := 0; i < len(nodes); i++ {
+        from := nodes[i]
+        tos := edges[from]
+        quoted := make([]string, len(tos))
+        for j := 0; j < len(tos); j++ {
+            to := tos[j]
+            quoted[j] = jsonString(to)
+            svg.Add(fmt.Sprintf("<line class=\"edge\" data-from=\"%s\" data-to=\"%s\" "+
+                "x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" marker-end=\"url(#arrow)\"/>\n",
+                xmlEscape(from), xmlEscape(to),
+                xs[from]+ws[from], ys[from]+boxHeight/2,
+                xs[to], ys[to]+boxHeight/2))
+        }
+        adjacency = append(adjacency, fmt.Sprintf("%s: [%s]",
+            jsonString(from), strings.Join(quoted, ", ")))
+    }
+
+    for i := 0; i < len(nodes); i++ {
+        n := nodes[i]
+        svg.Add(fmt.Sprintf("<g class=\"node\" data-name=\"%s\">"+
+            "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"4\" fill=\"%s\"/>"+
+            "<text x=\"%d\" y=\"%d\">%s</text></g>\n",
+            xmlEscape(n), xs[n], ys[n], ws[n], boxHeight, colors[d.kindName(n)],
+            xs[n]+8, ys[n]+16, xmlEscape(n)))
+    }
+
+    svg.Add("</svg>\n")
+
+    return svg.String(), adjacency
+}
+
+// standalone svg, the drawing of -graph-fmt html
+func (d Dag) graphSVG(nodes []string, edges map[string][]string) string {
+
+    svg, _ := d.drawing(nodes, edges, true)
+
+    return "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" + svg
+}
+
+func (d Dag) graphHTML(nodes []string, edges map[string][]string) string {
+
+    svg, adjacency := d.drawing(nodes, edges, false)
+
+    sb := stringbuffer.NewSize(len(svg) + 3000)
+
+    sb.Add(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>package graph</title>
+<style>
+  body { margin: 0; font-family: sans-serif; }
+  #help { padding: 4px 8px; font-size: 12px; color: #555; }
+  .node { cursor: pointer; }
+  .node text { font-family: monospace; font-size: 12px; pointer-events: none; }
+  .node rect { stroke: #333; }
+  .edge { stroke: #999; stroke-width: 1; }
+  .dim { opacity: 0.15; }
+  .hot rect { stroke: #d00; stroke-width: 2; }
+  .edge.hot { stroke: #d00; stroke-width: 2; }
+</style>
+</head>
+<body>
+<div id="help">scroll: zoom, drag: move, click package: highlight dependencies (click again to reset)</div>
+`)
+    sb.Add(svg)
+    sb.Add("<script>\nvar imports = {\n")
+    sb.Add(strings.Join(adjacency, ",\n"))
+    sb.Add(`
+};
+var svg = document.getElementById("graph");
+var box = svg.viewBox.baseVal;
+var selected = null;
+
+function reach(name, seen) {
+    if (seen[name]) { return; }
+    seen[name] = true;
+    (imports[name] || []).forEach(function (n) { reach(n, seen); });
+}
+
+function highlight(name) {
+    var seen = {};
+    if (name !== null) { reach(name, seen); }
+    Array.prototype.forEach.call(svg.querySelectorAll(".node"), function (g) {
+        var on = seen[g.getAttribute("data-name")];
+        g.setAttribute("class", name === null ? "node" : (on ? "node hot" : "node dim"));
+    });
+    Array.prototype.forEach.call(svg.querySelectorAll(".edge"), function (l) {
+        var on = seen[l.getAttribute("data-from")] && seen[l.getAttribute("data-to")];
+        l.setAttribute("class", name === null ? "edge" : (on ? "edge hot" : "edge dim"));
+    });
+}
+
+svg.addEventListener("click", function (ev) {
+    var g = ev.target.closest ? ev.target.closest(".node") : null;
+    var name = g ? g.getAttribute("data-name") : null;
+    selected = (name === selected) ? null : name;
+    highlight(selected);
+});
+
+svg.addEventListener("wheel", function (ev) {
+    ev.preventDefault();
+    var f = ev.deltaY > 0 ? 1.1 : 0.9;
+    var r = svg.getBoundingClientRect();
+    var x = box.x + (ev.clientX - r.left) / r.width * box.width;
+    var y = box.y + (ev.clientY - r.top) / r.height * box.height;
+    box.x = x - (x - box.x) * f;
+    box.y = y - (y - box.y) * f;
+    box.width *= f;
+    box.height *= f;
+});
+
+var drag = null;
+svg.addEventListener("mousedown", function (ev) { drag = [ev.clientX, ev.clientY]; });
+svg.addEventListener("mouseup", function () { drag = null; });
+svg.addEventListener("mousemove", function (ev) {
+    if (drag === null) { return; }
+    var r = svg.getBoundingClientRect();
+    box.x -= (ev.clientX - drag[0]) / r.width * box.width;
+    box.y -= (ev.clientY - drag[1]) / r.height * box.height;
+    drag = [ev.clientX, ev.clientY];
+});
+</script>
+</body>
+</html>
+`)
+
+    return sb.String()
+}
@@ -0,0 +1,287 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "exec"
+    "sort"
+    "strings"
+    "crypto/sha1"
+    "encoding/hex"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "utilz/handy"
+    "utilz/say"
+    "cmplr/dag"
+)
+
+// Generators run before the build, given in Go source as:
+//
+//  //go:generate command arg ..
+//  //gd:generate [-inputs file,file ..] command arg ..
+//
+// Generators of a package run after those of packages it imports,
+// in the directory of the file, with $GOFILE, $GOLINE, $GOPACKAGE
+// set (and expanded in the arguments). A generator only runs when
+// its declared inputs (and the file holding it) changed since it
+// last ran, the stamps are kept in .gd-generate in the -lib dir
+// (without -lib: in the temporary dir, never in the source tree).
+
+type generator struct {
+    file   string
+    line   int
+    inputs []string // relative to directory of file
+    argv   []string
+}
+
+// run generators found in files, true if any did run (then
+// the source tree should be walked again)
+func Generate(srcdir string, files []string) bool {
+
+    generators := make(map[string][]*generator)
+
+    for i := 0; i < len(files); i++ {
+        if gs := findGenerators(files[i]); len(gs) > 0 {
+            generators[files[i]] = gs
+        }
+    }
+
+    if len(generators) == 0 {
+        return false
+    }
+
+    // dependency order, from imports only
+    d := dag.New()
+    d.Parse(srcdir, files)
+    d.GraphBuilder()
+    sorted := d.Topsort()
+
+    stampFile := stampsFile(srcdir)
+    stamps := readStamps(stampFile)
+    ran := false
+
+    for i := 0; i < len(sorted); i++ {
+        pkgFiles := sorted[i].Files
+        for j := 0; j < len(pkgFiles); j++ {
+            gs := generators[pkgFiles[j]]
+            for k := 0; k < len(gs); k++ {
+                if runGenerator(gs[k], sorted[i].ShortName, stamps, stampFile) {
+                    ran = true
+                }
+            }
+        }
+    }
+
+    return ran
+}
+
+func findGenerators(file string) []*generator {
+
+    b, e := ioutil.ReadFile(file)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    gs := make([]*generator, 0)
+    lines := strings.Split(string(b), "\n", -1)
+
+    for i := 0; i < len(lines); i++ {
+
+        var argv []string
+        var gd bool
+
+        switch {
+        case strings.HasPrefix(lines[i], "//go:generate "):
+            argv = generateArgv(lines[i][len("//go:generate "):])
+        case strings.HasPrefix(lines[i], "//gd:generate "):
+            argv = generateArgv(lines[i][len("//gd:generate "):])
+            gd = true
+        default:
+            continue
+        }
+
+        g := &generator{file: file, line: i + 1}
+
+        if gd && len(argv) > 1 && argv[0] == "-inputs" {
+            g.inputs = strings.Split(argv[1], ",", -1)
+            argv = argv[2:]
+        }
+
+        if len(argv) == 0 {
+            log.Fatalf("[ERROR] %s:%d: generate: missing command\n", file, i+1)
+        }
+
+        g.argv = argv
+        gs = append(gs, g)
+    }
+
+    return gs
+}
+
+// words of a generate line, "quoted words" may contain spaces
+func generateArgv(line string) []string {
+
+    argv := make([]string, 0)
+    word := ""
+    inWord, quoted := false, false
+
+    for _, c := range strings.TrimSpace(line) {
+        switch {
+        case c == '"':
+            quoted = !quoted
+            inWord = true
+        case (c == ' ' || c == '\t') && !quoted:
+            if inWord {
+                argv = append(argv, word)
+            }
+            word, inWord = "", false
+        default:
+            word += string(c)
+            inWord = true
+        }
+    }
+
+    if inWord {
+        argv = append(argv, word)
+    }
+
+    return argv
+}
+
+// run g unless its inputs are unchanged, true if it ran
+func runGenerator(g *generator, pkgname string, stamps map[string]string, stampFile string) bool {
+
+    dir := filepath.Dir(g.file)
+
+    os.Setenv("GOFILE", filepath.Base(g.file))
+    os.Setenv("GOLINE", fmt.Sprintf("%d", g.line))
+    os.Setenv("GOPACKAGE", pkgname)
+
+    argv := make([]string, len(g.argv))
+
+    for i := 0; i < len(argv); i++ {
+        argv[i] = os.ShellExpand(g.argv[i])
+    }
+
+    key := g.file + " " + strings.Join(g.argv, " ")
+
+    if stamps[key] == generatorStamp(g) {
+        return false
+    }
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("(cd %s && %s) || exit 1\n", dir, strings.Join(argv, " "))
+        return false
+    }
+
+    path, e := exec.LookPath(argv[0])
+
+    if e != nil {
+        log.Printf("[ERROR] %s:%d: generate: %s\n", g.file, g.line, e)
+        handy.Exit(1)
+    }
+
+    say.Printf("generate : %s\n", strings.Join(argv, " "))
+
+    cmd := exec.Command(path, argv[1:]...)
+    cmd.Dir = dir
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+
+    if e = handy.Run(cmd); e != nil {
+        log.Printf("[ERROR] %s:%d: generate: %s\n", g.file, g.line, e)
+        handy.Exit(1)
+    }
+
+    // inputs may be generated too
+    stamps[key] = generatorStamp(g)
+    saveStamps(stamps, stampFile)
+
+    return true
+}
+
+// hash of the file holding g and its declared inputs
+func generatorStamp(g *generator) string {
+
+    h := sha1.New()
+
+    fmt.Fprintf(h, "file %s\n", hashFile(g.file))
+
+    for i := 0; i < len(g.inputs); i++ {
+        input := filepath.Join(filepath.Dir(g.file), g.inputs[i])
+        if _, e := os.Stat(input); e != nil {
+            log.Printf("[ERROR] %s:%d: generate: %s\n", g.file, g.line, e)
+            handy.Exit(1)
+        }
+        fmt.Fprintf(h, "input %s %s\n", g.inputs[i], hashFile(input))
+    }
+
+    return hex.EncodeToString(h.Sum())
+}
+
+func stampsFile(srcdir string) string {
+
+    if global.GetString("-lib") != "" {
+        return filepath.Join(global.GetString("-lib"), ".gd-generate")
+    }
+
+    // one per source tree
+    h := sha1.New()
+    fmt.Fprintf(h, "%s\n", absPath(srcdir))
+    stamp := hex.EncodeToString(h.Sum())[:12]
+
+    return filepath.Join(os.TempDir(), "gd-generate-"+stamp)
+}
+
+// generator -> stamp, lines are: stamp generator
+func readStamps(stampFile string) map[string]string {
+
+    stamps := make(map[string]string)
+
+    b, e := ioutil.ReadFile(stampFile)
+
+    if e == nil {
+        lines := strings.Split(string(b), "\n", -1)
+        for i := 0; i < len(lines); i++ {
+            space := strings.Index(lines[i], " ")
+            if space > 0 {
+                stamps[lines[i][space+1:]] = lines[i][:space]
+            }
+        }
+    }
+
+    return stamps
+}
+
+func saveStamps(stamps map[string]string, stampFile string) {
+
+    keys := make([]string, 0)
+
+    for k, _ := range stamps {
+        keys = append(keys, k)
+    }
+
+    sort.SortStrings(keys)
+
+    lines := make([]string, len(keys))
+
+    for i := 0; i < len(keys); i++ {
+        lines[i] = fmt.Sprintf("%s %s\n", stamps[keys[i]], keys[i])
+    }
+
+    handy.DirOrMkdir(filepath.Dir(stampFile))
+
+    e := ioutil.WriteFile(stampFile, []byte(strings.Join(lines, "")), 0644)
+
+    if e != nil {
+        log.Printf("[WARNING] %s\n", e)
+    }
+}
@@ -0,0 +1,152 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "go/ast"
+    "go/parser"
+    "log"
+    "fmt"
+    "strings"
+    "utilz/stringbuffer"
+)
+
+// C header for the functions of a package marked with an
+// '//export Name' comment (the cgo convention), the C name
+// is bound to the symbol of the Go function (package.Func)
+
+// C types of Go types that can cross over
+var cTypes = map[string]string{
+    "int":            "GoInt",
+    "uint":           "GoUint",
+    "int8":           "int8_t",
+    "int16":          "int16_t",
+    "int32":          "int32_t",
+    "int64":          "int64_t",
+    "uint8":          "uint8_t",
+    "byte":           "uint8_t",
+    "uint16":         "uint16_t",
+    "uint32":         "uint32_t",
+    "uint64":         "uint64_t",
+    "uintptr":        "uintptr_t",
+    "float32":        "float",
+    "float64":        "double",
+    "bool":           "_Bool",
+    "string":         "GoString",
+    "unsafe.Pointer": "void*",
+}
+
+func (p *Package) CHeader(guard string) string {
+
+    sb := stringbuffer.NewSize(500)
+
+    sb.Add(fmt.Sprintf("/* generated by gd from: %s, do not edit */\n\n", p.Name))
+    sb.Add(fmt.Sprintf("#ifndef %s\n#define %s\n\n", guard, guard))
+    sb.Add("#include <stdint.h>\n\n")
+    sb.Add("typedef int GoInt;\n")
+    sb.Add("typedef unsigned int GoUint;\n")
+    sb.Add("typedef struct { const unsigned char *p; GoInt n; } GoString;\n\n")
+
+    for i := 0; i < len(p.Files); i++ {
+
+        if strings.HasSuffix(p.Files[i], "_test.go") {
+            continue
+        }
+
+        tree := getSyntaxTreeOrDie(p.Files[i], parser.ParseComments)
+
+        for j := 0; j < len(tree.Decls); j++ {
+            if fn, ok := tree.Decls[j].(*ast.FuncDecl); ok {
+                if name := exportName(fn); name != "" {
+                    if decl := cDeclaration(p.ShortName, name, fn); decl != "" {
+                        sb.Add(decl)
+                    }
+                }
+            }
+        }
+    }
+
+    sb.Add("\n#endif\n")
+
+    return sb.String()
+}
+
+// name given by '//export Name', "" if not exported (or a method)
+func exportName(fn *ast.FuncDecl) string {
+
+    if fn.Doc == nil || fn.Recv != nil {
+        return ""
+    }
+
+    for i := 0; i < len(fn.Doc.List); i++ {
+        text := string(fn.Doc.List[i].Text)
+        if strings.HasPrefix(text, "//export ") {
+            return strings.TrimSpace(text[len("//export "):])
+        }
+    }
+
+    return ""
+}
+
+func cDeclaration(pkgname, name string, fn *ast.FuncDecl) string {
+
+    result := "void"
+    params := make([]string, 0)
+
+    if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 {
+
+        results := fn.Type.Results.List
+
+        if len(results) > 1 || len(results[0].Names) > 1 {
+            log.Printf("[WARNING] //export %s: multiple results\n", name)
+            return ""
+        }
+
+        if result = cType(results[0].Type); result == "" {
+            log.Printf("[WARNING] //export %s: unsupported result type\n", name)
+            return ""
+        }
+    }
+
+    for _, field := range fn.Type.Params.List {
+
+        ctype := cType(field.Type)
+
+        if ctype == "" {
+            log.Printf("[WARNING] //export %s: unsupported parameter type\n", name)
+            return ""
+        }
+
+        if len(field.Names) == 0 {
+            params = append(params, ctype)
+        }
+
+        for i := 0; i < len(field.Names); i++ {
+            params = append(params, ctype+" "+field.Names[i].Name)
+        }
+    }
+
+    if len(params) == 0 {
+        params = append(params, "void")
+    }
+
+    return fmt.Sprintf("extern %s %s(%s) __asm__(\"%s.%s\");\n",
+        result, name, strings.Join(params, ", "), pkgname, fn.Name.Name)
+}
+
+// "" if the type has no C counterpart
+func cType(expr ast.Expr) string {
+    switch t := expr.(type) {
+    case *ast.Ident:
+        return cTypes[t.Name]
+    case *ast.StarExpr:
+        return "void*"
+    case *ast.SelectorExpr:
+        if x, ok := t.X.(*ast.Ident); ok {
+            return cTypes[x.Name+"."+t.Sel.Name]
+        }
+    }
+    return ""
+}
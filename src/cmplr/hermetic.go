@@ -0,0 +1,278 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "exec"
+    "path/filepath"
+    "utilz/stringset"
+    "utilz/handy"
+    "cmplr/dag"
+)
+
+// Hermetic mode (-hermetic): each compile and link runs with an
+// explicitly declared environment (the rest is scrubbed) inside a
+// private temporary directory, which only holds symlinks to the
+// declared inputs, the command must produce the declared output
+// and nothing else. The standard library is found through the
+// declared $GOROOT, gccgo finds its own relative to the binary.
+//
+// Paths are mapped into the sandbox as sandbox/root/<absolute path>,
+// so directories given with -I and -L only contain declared inputs.
+
+var hermeticVars = []string{"GOROOT", "GOOS", "GOARCH"}
+
+type sandbox struct {
+    dir    string
+    inputs *stringset.StringSet // absolute paths
+    output string               // absolute path
+}
+
+func newSandbox(inputs []string, output string) (*sandbox, os.Error) {
+
+    dir, e := ioutil.TempDir("", "gd-hermetic")
+
+    if e != nil {
+        return nil, e
+    }
+
+    s := new(sandbox)
+    s.dir = dir
+    s.inputs = stringset.New()
+    s.output = absPath(output)
+
+    for i := 0; i < len(inputs); i++ {
+
+        input := absPath(inputs[i])
+        inside := s.path(input)
+
+        if !s.inputs.Add(input) {
+            continue
+        }
+
+        if e = os.MkdirAll(filepath.Dir(inside), 0777); e != nil {
+            return s, e
+        }
+
+        if e = os.Symlink(input, inside); e != nil {
+            return s, e
+        }
+    }
+
+    return s, os.MkdirAll(filepath.Dir(s.path(s.output)), 0777)
+}
+
+func (s *sandbox) path(pathname string) string {
+    return filepath.Join(s.dir, "root", absPath(pathname))
+}
+
+// output and input files, and directories given to
+// -I, -L and -o, are replaced by their sandbox paths
+func (s *sandbox) argv(argv []string) []string {
+
+    inside := make([]string, len(argv))
+    inside[0] = argv[0]
+
+    for i := 1; i < len(argv); i++ {
+        switch {
+        case argv[i-1] == "-I" || argv[i-1] == "-L":
+            inside[i] = s.path(argv[i])
+            os.MkdirAll(inside[i], 0777)
+        case argv[i-1] == "-o" || s.inputs.Contains(absPath(argv[i])):
+            inside[i] = s.path(argv[i])
+        default:
+            inside[i] = argv[i]
+        }
+    }
+
+    return inside
+}
+
+func (s *sandbox) env(argv0 string) []string {
+
+    env := []string{
+        "PATH=" + filepath.Dir(argv0),
+        "HOME=" + s.dir,
+        "TMPDIR=" + s.dir,
+        "LANG=C",
+    }
+
+    for i := 0; i < len(hermeticVars); i++ {
+        if v := os.Getenv(hermeticVars[i]); v != "" {
+            env = append(env, hermeticVars[i]+"="+v)
+        }
+    }
+
+    return env
+}
+
+// regular files below dir, symlinks (inputs) are not followed
+func regularFiles(dir string, files []string) []string {
+
+    entries, e := ioutil.ReadDir(dir)
+
+    if e != nil {
+        return files
+    }
+
+    for i := 0; i < len(entries); i++ {
+        pathname := filepath.Join(dir, entries[i].Name)
+        if entries[i].IsDirectory() {
+            files = regularFiles(pathname, files)
+        } else if entries[i].IsRegular() {
+            files = append(files, pathname)
+        }
+    }
+
+    return files
+}
+
+// only the declared output may be produced, it is moved
+// to its real location when everything checks out
+func (s *sandbox) collect() os.Error {
+
+    inside := s.path(s.output)
+    files := regularFiles(s.dir, nil)
+
+    for i := 0; i < len(files); i++ {
+        if files[i] != inside {
+            return os.NewError(fmt.Sprintf("[hermetic] undeclared output: %s",
+                files[i][len(s.dir)+1:]))
+        }
+    }
+
+    if len(files) == 0 {
+        return os.NewError("[hermetic] missing output: " + s.output)
+    }
+
+    if os.Rename(inside, s.output) == nil {
+        return nil
+    }
+
+    // sandbox on another filesystem
+    b, e := ioutil.ReadFile(inside)
+
+    if e != nil {
+        return e
+    }
+
+    return ioutil.WriteFile(s.output, b, 0755)
+}
+
+// sandbox paths in compiler messages back to real paths
+func (s *sandbox) rewrite(output []byte) []byte {
+    root := filepath.Join(s.dir, "root")
+    return []byte(strings.Replace(string(output), root, "", -1))
+}
+
+// run argv hermetically, returns output (stdout+stderr) and success
+func hermetic(argv, inputs []string, output string) ([]byte, bool) {
+
+    s, e := newSandbox(inputs, output)
+
+    if s != nil {
+        handy.Partial(s.dir)
+        defer handy.Complete(s.dir)
+        defer os.RemoveAll(s.dir)
+    }
+
+    if e != nil {
+        return []byte(fmt.Sprintf("[ERROR] %s\n", e)), false
+    }
+
+    inside := s.argv(argv)
+
+    var buffer bytes.Buffer
+
+    cmd := exec.Command(inside[0], inside[1:]...)
+    cmd.Env = s.env(argv[0])
+    cmd.Dir = s.dir
+    cmd.Stdout = &buffer
+    cmd.Stderr = &buffer
+
+    e = handy.Run(cmd)
+    out := s.rewrite(buffer.Bytes())
+
+    if e != nil {
+        return append(out, []byte(fmt.Sprintf("[ERROR] %s\n", e))...), false
+    }
+
+    if e = s.collect(); e != nil {
+        return append(out, []byte(fmt.Sprintf("[ERROR] %s\n", e))...), false
+    }
+
+    return out, true
+}
+
+// declared inputs of a compile: source files, objects of imports
+// (for the test main: main packages compiled by CompileMainTests)
+func compileInputs(pkg *dag.Package) []string {
+
+    inputs := make([]string, 0)
+    inputs = append(inputs, pkg.Files...)
+
+    deps := pkg.Dependencies()
+
+    for i := 0; i < len(deps); i++ {
+        if object := findObject(deps[i]); object != "" {
+            inputs = append(inputs, object)
+        }
+        if suffix == ".o" {
+            gox := filepath.Join(libroot, deps[i]) + ".gox"
+            if _, e := os.Stat(gox); e == nil {
+                inputs = append(inputs, gox)
+            }
+        }
+    }
+
+    return inputs
+}
+
+// declared inputs of a link: objects of local packages (and
+// of main packages under test), objects below the -I directories
+func linkInputs(pkgs, extra []*dag.Package) []string {
+
+    inputs := make([]string, 0)
+
+    for i := 0; i < len(pkgs); i++ {
+        inputs = append(inputs, objectFile(pkgs[i]))
+        inputs = append(inputs, looseObjects(objectFile(pkgs[i]))...)
+    }
+
+    for i := 0; i < len(extra); i++ {
+        inputs = append(inputs, objectFile(extra[i]))
+        if extra[i].ShortName == "main" && suffix == ".o" {
+            inputs = append(inputs, testObject(extra[i]))
+            inputs = append(inputs, looseObjects(testObject(extra[i]))...)
+        }
+    }
+
+    for i := 0; i < len(includes); i++ {
+        files := regularFiles(includes[i], nil)
+        for j := 0; j < len(files); j++ {
+            if strings.HasSuffix(files[j], suffix) || strings.HasSuffix(files[j], ".a") {
+                inputs = append(inputs, files[j])
+            }
+        }
+    }
+
+    return inputs
+}
+
+func absPath(pathname string) string {
+    if filepath.IsAbs(pathname) {
+        return filepath.Clean(pathname)
+    }
+    pwd, e := os.Getwd()
+    if e != nil {
+        return filepath.Clean(pathname)
+    }
+    return filepath.Join(pwd, pathname)
+}
@@ -0,0 +1,230 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "runtime"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "utilz/say"
+    "cmplr/dag"
+)
+
+// gd install -prefix DIR (after a build):
+//
+//  DIR/bin/<name>                    main packages (linked)
+//  DIR/pkg/<os>_<arch>/<pkg><suffix> other packages (-I, -L DIR/pkg/..),
+//                                    archives if built with -pack
+//  DIR/share/gd/<project>.manifest   what was installed, for uninstall
+
+func Install(prefix, project string, pkgs []*dag.Package) {
+
+    var installed []string // relative to prefix
+
+    mains := make([]*dag.Package, 0)
+    libs := make([]*dag.Package, 0)
+
+    for i := 0; i < len(pkgs); i++ {
+        if pkgs[i].ShortName == "main" {
+            mains = append(mains, pkgs[i])
+        } else if !strings.HasSuffix(pkgs[i].ShortName, "_test") {
+            libs = append(libs, pkgs[i])
+        }
+    }
+
+    for i := 0; i < len(libs); i++ {
+        rel := filepath.Join("pkg", platform(), objectName(libs[i]))
+        installFile(objectFile(libs[i]), filepath.Join(prefix, rel))
+        installed = append(installed, rel)
+    }
+
+    for i := 0; i < len(mains); i++ {
+        rel := filepath.Join("bin", binaryName(mains[i], project, len(mains)))
+        if !global.GetBool("-dryrun") {
+            mkdirOrDie(filepath.Join(prefix, "bin"))
+        }
+        // only one main package for ForkLink to find
+        ForkLink(filepath.Join(prefix, rel), append(libs, mains[i]), nil)
+        installed = append(installed, rel)
+        if linkMode(mains[i]) != exeMode {
+            installed = append(installed, headerFile(rel))
+        }
+    }
+
+    writeManifest(prefix, project, installed)
+}
+
+// remove everything listed in the manifest of project
+func Uninstall(prefix, project string) {
+
+    manifest := manifestFile(prefix, project)
+    installed := readManifest(manifest)
+
+    if installed == nil {
+        log.Fatalf("[ERROR] uninstall: no manifest: %s\n", manifest)
+    }
+
+    for i := 0; i < len(installed); i++ {
+        removeInstalled(prefix, filepath.Join(prefix, installed[i]))
+    }
+
+    removeInstalled(prefix, manifest)
+}
+
+// os_arch (like $GOROOT/pkg/os_arch)
+func platform() string {
+
+    O := os.Getenv("GOOS")
+    if O == "" {
+        O = runtime.GOOS
+    }
+
+    A := global.GetString("-arch")
+    if A == "" {
+        A = os.Getenv("GOARCH")
+    }
+    if A == "" {
+        A = runtime.GOARCH
+    }
+
+    return O + "_" + A
+}
+
+// -output (if only one main), else name of directory holding main
+func binaryName(pkg *dag.Package, project string, mains int) string {
+
+    if mains == 1 && global.GetString("-output") != "" {
+        return filepath.Base(global.GetString("-output"))
+    }
+
+    dir := filepath.Dir(pkg.Name)
+
+    if dir == "." {
+        return project
+    }
+
+    return filepath.Base(dir)
+}
+
+func installFile(src, dst string) {
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("[dryrun] install: %s -> %s\n", src, dst)
+        return
+    }
+
+    b, e := ioutil.ReadFile(src)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    mkdirOrDie(filepath.Dir(dst))
+
+    e = ioutil.WriteFile(dst, b, 0644)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    say.Printf("install  : %s\n", dst)
+}
+
+// remove file, and directories below prefix left empty
+func removeInstalled(prefix, pathname string) {
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("[dryrun] rm: %s\n", pathname)
+        return
+    }
+
+    e := os.Remove(pathname)
+
+    if e != nil {
+        log.Printf("[ERROR] %s\n", e)
+        return
+    }
+
+    say.Printf("rm: %s\n", pathname)
+
+    prefix = filepath.Clean(prefix)
+
+    for dir := filepath.Dir(pathname); dir != prefix && dir != "."; {
+        if os.Remove(dir) != nil {
+            break
+        }
+        dir = filepath.Dir(dir)
+    }
+}
+
+func mkdirOrDie(dir string) {
+    e := os.MkdirAll(dir, 0755)
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+}
+
+func manifestFile(prefix, project string) string {
+    return filepath.Join(prefix, "share", "gd", project+".manifest")
+}
+
+// installed files relative to prefix, nil if no manifest
+func readManifest(manifest string) []string {
+
+    b, e := ioutil.ReadFile(manifest)
+
+    if e != nil {
+        return nil
+    }
+
+    files := make([]string, 0)
+    lines := strings.Split(string(b), "\n", -1)
+
+    for i := 0; i < len(lines); i++ {
+        if strings.TrimSpace(lines[i]) != "" {
+            files = append(files, lines[i])
+        }
+    }
+
+    return files
+}
+
+// earlier installs of project are kept in the manifest
+func writeManifest(prefix, project string, installed []string) {
+
+    manifest := manifestFile(prefix, project)
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("[dryrun] manifest: %s\n", manifest)
+        return
+    }
+
+    files := readManifest(manifest)
+    seen := make(map[string]bool)
+
+    for i := 0; i < len(files); i++ {
+        seen[files[i]] = true
+    }
+
+    for i := 0; i < len(installed); i++ {
+        if !seen[installed[i]] {
+            files = append(files, installed[i])
+            seen[installed[i]] = true
+        }
+    }
+
+    mkdirOrDie(filepath.Dir(manifest))
+
+    e := ioutil.WriteFile(manifest, []byte(strings.Join(files, "\n")+"\n"), 0644)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+}
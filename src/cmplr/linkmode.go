@@ -0,0 +1,225 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "exec"
+    "sort"
+    "bytes"
+    "regexp"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "utilz/handy"
+    "utilz/say"
+    "cmplr/dag"
+)
+
+// Link modes (-link-mode), what ForkLink produces from a main package:
+//
+//  exe        executable (default)
+//  c-archive  static archive for a C program (which links with -lgo)
+//  c-shared   shared object for a C program (objects get -fPIC)
+//
+// Either a single mode for every main package, or REGEX=MODE,..
+// where the first regex matching the main package selects the mode.
+// Modes apply to -output and install, the test main is always exe.
+// c-archive and c-shared also write a C header (output.h) for the
+// functions marked '//export Name', these need the gccgo backend.
+// Objects compiled with -fPIC are kept apart (libroot/_pic), so a
+// change of mode never links objects compiled for the other one.
+
+const (
+    exeMode     = "exe"
+    archiveMode = "c-archive"
+    sharedMode  = "c-shared"
+)
+
+func linkMode(pkg *dag.Package) string {
+
+    spec := global.GetString("-link-mode")
+
+    // test main: see CreateTestMainArgv
+    if _, test := objectRoots[pkg]; spec == "" || test {
+        return exeMode
+    }
+
+    rules := strings.Split(spec, ",", -1)
+
+    for i := 0; i < len(rules); i++ {
+
+        eq := strings.LastIndex(rules[i], "=")
+
+        if eq < 0 {
+            return checkMode(rules[i])
+        }
+
+        ok, e := regexp.MatchString(rules[i][:eq], pkg.Name)
+
+        if e != nil {
+            log.Fatalf("[ERROR] -link-mode: %s\n", e)
+        }
+
+        if ok {
+            return checkMode(rules[i][eq+1:])
+        }
+    }
+
+    return exeMode
+}
+
+func checkMode(mode string) string {
+
+    switch mode {
+    case exeMode:
+        return mode
+    case archiveMode, sharedMode:
+        switch global.GetString("-backend") {
+        case "gcc", "gccgo":
+            return mode
+        }
+        log.Fatalf("[ERROR] -link-mode %s: not supported by backend: %s\n",
+            mode, global.GetString("-backend"))
+    default:
+        log.Fatalf("[ERROR] -link-mode: unknown mode: %s\n", mode)
+    }
+
+    return ""
+}
+
+var pic bool // some main package is linked -link-mode c-shared
+
+// objects that may end up in a shared object are compiled with -fPIC
+func positionIndependent() bool {
+    return pic
+}
+
+// find out if pkgs need -fPIC (from the mode of each main package),
+// before anything else looks in libroot
+func InitLinkMode(pkgs []*dag.Package) {
+
+    pic = false
+
+    for i := 0; i < len(pkgs); i++ {
+        if pkgs[i].ShortName == "main" && linkMode(pkgs[i]) == sharedMode {
+            pic = true
+        }
+    }
+
+    if pic {
+        libroot = filepath.Join(libroot, "_pic")
+        handy.DirOrMkdir(libroot)
+    }
+}
+
+// c-archive: ar keeps archives given to it as members, which a C
+// linker never looks into, so the members of packed packages are
+// extracted (a directory for each archive) and added one by one;
+// q appends, members of different archives share names (_go_.o).
+// This is not done hermetically (-hermetic).
+func linkArchive(output string, objects []string) {
+
+    var buffer bytes.Buffer
+
+    ar, e := exec.LookPath("ar")
+
+    if e != nil {
+        log.Fatalf("[ERROR] -link-mode %s: %s\n", archiveMode, e)
+    }
+
+    loose := make([]string, 0)
+    archives := make([]string, 0)
+
+    for i := 0; i < len(objects); i++ {
+        if strings.HasSuffix(objects[i], ".a") {
+            archives = append(archives, objects[i])
+        } else {
+            loose = append(loose, objects[i])
+        }
+    }
+
+    if global.GetBool("-dryrun") {
+        steps := []step{step{argv: []string{"rm", "-f", output}}}
+        steps = append(steps, step{argv: append([]string{ar, "qcs", output}, loose...)})
+        for i := 0; i < len(archives); i++ {
+            dir := filepath.Join("$WORK", fmt.Sprintf("%d", i))
+            steps = append(steps, step{argv: []string{"mkdir", dir}})
+            steps = append(steps, step{argv: []string{ar, "x", absPath(archives[i])}, dir: dir})
+            steps = append(steps, step{argv: []string{ar, "qs", output, dir + "/*"}})
+        }
+        printSteps(steps)
+        return
+    }
+
+    work, e := ioutil.TempDir("", "gd-archive")
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    defer os.RemoveAll(work)
+
+    say.Println("linking  :", output)
+    handy.Partial(output)
+    defer handy.Complete(output)
+
+    os.Remove(output) // ar adds to existing archives
+
+    ok := runStep(step{argv: append([]string{ar, "qcs", output}, loose...)}, &buffer)
+
+    for i := 0; ok && i < len(archives); i++ {
+
+        dir := filepath.Join(work, fmt.Sprintf("%d", i))
+
+        if e = os.Mkdir(dir, 0777); e != nil {
+            log.Fatalf("[ERROR] %s\n", e)
+        }
+
+        ok = runStep(step{argv: []string{ar, "x", absPath(archives[i])}, dir: dir}, &buffer)
+
+        if members := regularFiles(dir, nil); ok && len(members) > 0 {
+            sort.SortStrings(members)
+            ok = runStep(step{argv: append([]string{ar, "qs", output}, members...)}, &buffer)
+        }
+    }
+
+    os.Stderr.Write(buffer.Bytes())
+
+    if !ok {
+        log.Printf("[ERROR] failed to link: %s\n", output)
+        handy.Exit(1)
+    }
+}
+
+// output.h (output without its extension)
+func headerFile(output string) string {
+    return output[:len(output)-len(filepath.Ext(output))] + ".h"
+}
+
+func writeHeader(output string, pkg *dag.Package) {
+
+    header := headerFile(output)
+
+    if global.GetBool("-dryrun") {
+        fmt.Printf("[dryrun] header: %s\n", header)
+        return
+    }
+
+    guard := strings.ToUpper(filepath.Base(header))
+    guard = "GD_" + regexp.MustCompile("[^A-Z0-9]").ReplaceAllString(guard, "_")
+
+    e := ioutil.WriteFile(header, []byte(pkg.CHeader(guard)), 0644)
+
+    if e != nil {
+        log.Printf("[ERROR] %s\n", e)
+        handy.Exit(1)
+    }
+
+    say.Println("header   :", header)
+}
@@ -0,0 +1,174 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "fmt"
+    "go/ast"
+    "path/filepath"
+    "sort"
+    "strings"
+    "parse/rules"
+    "utilz/stringset"
+)
+
+// collects identifiers used as: X.Sel
+type selectorCollector struct {
+    used *stringset.StringSet
+}
+
+func newSelectorCollector() *selectorCollector {
+    s := new(selectorCollector)
+    s.used = stringset.New()
+    return s
+}
+
+func (s *selectorCollector) Visit(node ast.Node) (v ast.Visitor) {
+    switch node.(type) {
+    case *ast.SelectorExpr:
+        sel, _ := node.(*ast.SelectorExpr)
+        ident, ok := sel.X.(*ast.Ident)
+        if ok {
+            s.used.Add(ident.Name)
+        }
+    default: // nothing to do if not SelectorExpr
+    }
+    return s
+}
+
+// Report unused, duplicate and illegal (according to rules)
+// imports for each package, and local packages nobody imports.
+// Duplicate: imported more than once by the files of a package
+// (renamed: under different names), every location is listed.
+// Returns the number of problems found.
+func (d Dag) LintImports(rs []*rules.Rule) int {
+
+    var problems int
+
+    imported := stringset.New()
+
+    for _, v := range d {
+        for dep := range v.dependencies.Iter() {
+            if d.localDependency(dep) && dep != v.Name {
+                imported.Add(dep)
+            }
+        }
+    }
+
+    for _, k := range d.names() {
+
+        v := d[k]
+        report := make([]string, 0)
+        imports := make(map[string][]string) // path -> locations
+        aliases := make(map[string][]string) // path -> "as name location"
+
+        for i := 0; i < len(v.Files); i++ {
+
+            tree := getSyntaxTreeOrDie(v.Files[i], 0)
+            specs := fileImports(tree)
+
+            collector := newSelectorCollector()
+            ast.Walk(collector, tree)
+
+            for j := 0; j < len(specs); j++ {
+
+                s := specs[j]
+                name := s.Name
+
+                if name == "" {
+                    name = d.importName(s.Path)
+                }
+
+                imports[s.Path] = append(imports[s.Path], s.Location)
+                aliases[s.Path] = append(aliases[s.Path], "as "+name+" "+s.Location)
+
+                if name != "_" && name != "." && !pseudoPackage(s.Path) &&
+                    !collector.used.Contains(name) {
+                    report = append(report, fmt.Sprintf("unused    : \"%s\" %s",
+                        s.Path, s.Location))
+                }
+
+                if r := rules.Check(rs, k, s.Path); r != nil {
+                    report = append(report, fmt.Sprintf("layering  : \"%s\" %s violates %s",
+                        s.Path, s.Location, r))
+                }
+            }
+        }
+
+        paths := make([]string, 0)
+
+        for path, _ := range imports {
+            paths = append(paths, path)
+        }
+
+        sort.SortStrings(paths)
+
+        for i := 0; i < len(paths); i++ {
+
+            locations := imports[paths[i]]
+
+            if len(locations) < 2 {
+                continue
+            }
+
+            report = append(report, fmt.Sprintf("duplicate : \"%s\" %s",
+                paths[i], strings.Join(locations, ", ")))
+
+            if renamed(aliases[paths[i]]) {
+                report = append(report, fmt.Sprintf("renamed   : \"%s\" %s",
+                    paths[i], strings.Join(aliases[paths[i]], ", ")))
+            }
+        }
+
+        if len(report) > 0 {
+            fmt.Println("p ", k)
+            for i := 0; i < len(report); i++ {
+                fmt.Println("  ", report[i])
+            }
+            fmt.Println("")
+            problems += len(report)
+        }
+    }
+
+    dead := make([]string, 0)
+
+    for _, k := range d.names() {
+        v := d[k]
+        if !imported.Contains(k) && v.ShortName != "main" &&
+            !strings.HasSuffix(v.ShortName, "_test") {
+            dead = append(dead, k)
+        }
+    }
+
+    if len(dead) > 0 {
+        fmt.Println("dead packages (not imported by any local package)")
+        for i := 0; i < len(dead); i++ {
+            fmt.Println("  ", dead[i])
+        }
+        fmt.Println("")
+        problems += len(dead)
+    }
+
+    return problems
+}
+
+// local packages know their name, others are assumed to
+// be named after the last element of the import path
+func (d Dag) importName(imprt string) string {
+    if p, ok := d[imprt]; ok {
+        return p.ShortName
+    }
+    return filepath.Base(imprt)
+}
+
+// true unless every alias ("as name location") has the same name
+func renamed(aliases []string) bool {
+    for i := 1; i < len(aliases); i++ {
+        if strings.Fields(aliases[i])[1] != strings.Fields(aliases[0])[1] {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,265 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/timer"
+    "utilz/say"
+    "utilz/global"
+)
+
+// Progress of a build: on a terminal a status line is kept at the
+// bottom (done/total, ETA and running jobs), compile time of each
+// package is recorded with utilz/timer for the summary of slowest
+// packages, and for the trace written to -timings (Chrome trace
+// event format, open with chrome://tracing).
+
+type span struct {
+    name  string
+    start int64 // ns since build started
+    delta int64 // ns spent compiling
+    lane  int   // tid in trace, one per parallel job
+}
+
+var epoch int64 = time.Nanoseconds()
+var spans = make([]*span, 0)
+var running = make(map[string]*span)
+var lanes = make([]bool, 0) // busy lanes
+var total, done int
+var begun int64 // start of current batch
+var interactive bool
+var statusShown bool
+
+func progressStart(pkgs int) {
+    total = pkgs
+    done = 0
+    begun = time.Nanoseconds()
+    interactive = isTerminal() &&
+        !global.GetBool("-quiet") && !global.GetBool("-dryrun")
+}
+
+func progressStop() {
+    clearStatus()
+    total = 0
+}
+
+// a package which needs no compilation (up 2 date, cached)
+func progressSkip(what, name string) {
+    done++
+    progressPrintln(what, name)
+}
+
+func progressBegin(name string) {
+
+    s := new(span)
+    s.name = name
+    s.start = time.Nanoseconds() - epoch
+    s.lane = freeLane()
+
+    running[name] = s
+    timer.Start("compile: " + name)
+
+    progressPrintln("compiling:", name)
+}
+
+func progressEnd(name string) {
+
+    s, ok := running[name]
+
+    if !ok {
+        return
+    }
+
+    timer.Stop("compile: " + name)
+    s.delta, _ = timer.Delta("compile: " + name)
+
+    running[name] = nil, false
+    lanes[s.lane] = false
+    spans = append(spans, s)
+    done++
+}
+
+func freeLane() int {
+    for i := 0; i < len(lanes); i++ {
+        if !lanes[i] {
+            lanes[i] = true
+            return i
+        }
+    }
+    lanes = append(lanes, true)
+    return len(lanes) - 1
+}
+
+func progressPrintln(args ...interface{}) {
+    clearStatus()
+    say.Println(args...)
+    drawStatus()
+}
+
+func clearStatus() {
+    if statusShown {
+        fmt.Print("\r\033[K")
+        statusShown = false
+    }
+}
+
+func drawStatus() {
+
+    if !interactive || total == 0 {
+        return
+    }
+
+    eta := "?"
+
+    if done > 0 {
+        elapsed := time.Nanoseconds() - begun
+        eta = timer.Nano2Time(elapsed / int64(done) * int64(total-done)).String()
+    }
+
+    names := make([]string, 0)
+    for k, _ := range running {
+        names = append(names, k)
+    }
+    sort.SortStrings(names)
+
+    status := fmt.Sprintf("[%d/%d] %3d%%  eta: %s  %s", done, total,
+        done*100/total, eta, strings.Join(names, " "))
+
+    // wrapping would break the \r trick
+    if len(status) > 79 {
+        status = status[:76] + "..."
+    }
+
+    fmt.Print(status)
+    statusShown = true
+}
+
+func isTerminal() bool {
+    if os.Getenv("TERM") == "dumb" {
+        return false
+    }
+    fi, e := os.Stdout.Stat()
+    return e == nil && fi.IsChar()
+}
+
+type byDelta []*span
+
+func (b byDelta) Len() int           { return len(b) }
+func (b byDelta) Less(i, j int) bool { return b[i].delta > b[j].delta }
+func (b byDelta) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// print the slowest packages, write -timings if set
+func ReportTimings() {
+
+    if len(spans) == 0 {
+        return
+    }
+
+    slow := make([]*span, len(spans))
+    copy(slow, spans)
+    sort.Sort(byDelta(slow))
+
+    say.Println("slowest  :")
+
+    for i := 0; i < len(slow) && i < 5; i++ {
+        say.Printf("%14s   %s\n", timer.Nano2Time(slow[i].delta), slow[i].name)
+    }
+
+    if global.GetString("-timings") != "" {
+        writeTrace(global.GetString("-timings"))
+    }
+
+    // nothing is written unless asked for
+    if global.GetBool("-critical") || global.GetString("-timings") != "" {
+        saveTimes()
+    }
+}
+
+// compile times are kept between builds (up to date packages
+// are not compiled, so the last known time is used for those),
+// recorded by builds with -critical or -timings
+func timesFile() string {
+    return filepath.Join(libroot, ".gd-times")
+}
+
+// package -> ns spent compiling it
+func Times() map[string]int64 {
+
+    times := make(map[string]int64)
+
+    b, e := ioutil.ReadFile(timesFile())
+
+    if e == nil {
+        lines := strings.Split(string(b), "\n", -1)
+        for i := 0; i < len(lines); i++ {
+            space := strings.LastIndex(lines[i], " ")
+            if space > 0 {
+                ns, e := strconv.Atoi64(lines[i][space+1:])
+                if e == nil {
+                    times[lines[i][:space]] = ns
+                }
+            }
+        }
+    }
+
+    for i := 0; i < len(spans); i++ {
+        times[spans[i].name] = spans[i].delta
+    }
+
+    return times
+}
+
+func saveTimes() {
+
+    times := Times()
+    names := make([]string, 0)
+
+    for k, _ := range times {
+        names = append(names, k)
+    }
+
+    sort.SortStrings(names)
+
+    lines := make([]string, len(names))
+
+    for i := 0; i < len(names); i++ {
+        lines[i] = fmt.Sprintf("%s %d\n", names[i], times[names[i]])
+    }
+
+    e := ioutil.WriteFile(timesFile(), []byte(strings.Join(lines, "")), 0644)
+
+    if e != nil {
+        log.Printf("[WARNING] %s\n", e)
+    }
+}
+
+func writeTrace(filename string) {
+
+    events := make([]string, len(spans))
+
+    for i := 0; i < len(spans); i++ {
+        events[i] = fmt.Sprintf("  {\"name\": %q, \"cat\": \"compile\", "+
+            "\"ph\": \"X\", \"ts\": %d, \"dur\": %d, \"pid\": 1, \"tid\": %d}",
+            spans[i].name, spans[i].start/1000, spans[i].delta/1000, spans[i].lane)
+    }
+
+    content := fmt.Sprintf("{\"displayTimeUnit\": \"ms\", \"traceEvents\": [\n%s\n]}\n",
+        strings.Join(events, ",\n"))
+
+    e := ioutil.WriteFile(filename, []byte(content), 0644)
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+}
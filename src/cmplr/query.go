@@ -0,0 +1,253 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package dag
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "strings"
+    "path/filepath"
+    "utilz/stringset"
+)
+
+// Answer questions about the package graph:
+//
+//  deps <pkg>          imports of pkg
+//  rdeps <pkg>         local packages importing pkg
+//  path <a> <b>        shortest import chain from a to b
+//  leaves              local packages importing no local package
+//  roots               local packages no local package imports
+//  affected <file..>   packages to rebuild/retest if files change
+//
+// deps and rdeps are transitive if transitive is true.
+func (d Dag) Query(args []string, transitive, asJSON bool) {
+
+    var result []string
+
+    if len(args) == 0 {
+        log.Fatal("[ERROR] query: missing command " +
+            "[deps,rdeps,path,leaves,roots,affected]\n")
+    }
+
+    switch args[0] {
+    case "deps":
+        queryArgs(args, 1)
+        result = d.Deps(d.queryPackage(args[1]), transitive)
+    case "rdeps":
+        queryArgs(args, 1)
+        result = d.RDeps(d.queryPackage(args[1]), transitive)
+    case "path":
+        queryArgs(args, 2)
+        result = d.Path(d.queryPackage(args[1]), args[2])
+        if result == nil {
+            log.Fatalf("[ERROR] query: %s does not import %s\n", args[1], args[2])
+        }
+    case "leaves":
+        queryArgs(args, 0)
+        result = d.Leaves()
+    case "roots":
+        queryArgs(args, 0)
+        result = d.Roots()
+    case "affected":
+        if len(args) < 2 {
+            log.Fatal("[ERROR] query: affected needs at least one file\n")
+        }
+        result = d.Affected(args[1:])
+    default:
+        log.Fatalf("[ERROR] query: unknown command: %s\n", args[0])
+    }
+
+    if asJSON {
+        quoted := make([]string, len(result))
+        for i := 0; i < len(result); i++ {
+            quoted[i] = jsonString(result[i])
+        }
+        fmt.Printf("[%s]\n", strings.Join(quoted, ", "))
+    } else {
+        for i := 0; i < len(result); i++ {
+            fmt.Println(result[i])
+        }
+    }
+}
+
+func queryArgs(args []string, n int) {
+    if len(args)-1 != n {
+        log.Fatalf("[ERROR] query: %s takes %d argument(s)\n", args[0], n)
+    }
+}
+
+func (d Dag) queryPackage(name string) string {
+    if !d.localDependency(name) {
+        log.Fatalf("[ERROR] query: unknown package: %s\n", name)
+    }
+    return name
+}
+
+// imports of a package, through local packages if transitive
+func (d Dag) Deps(name string, transitive bool) []string {
+
+    set := stringset.New()
+    todo := []string{name}
+
+    for len(todo) > 0 {
+        node := todo[0]
+        todo = todo[1:]
+        if p, ok := d[node]; ok {
+            for dep := range p.dependencies.Iter() {
+                if set.Add(dep) && transitive {
+                    todo = append(todo, dep)
+                }
+            }
+        }
+    }
+
+    set.Remove(name)
+
+    return set.Slice()
+}
+
+// local packages that import name, directly or transitively
+func (d Dag) RDeps(name string, transitive bool) []string {
+
+    set := stringset.New()
+    todo := []string{name}
+
+    for len(todo) > 0 {
+        node := todo[0]
+        todo = todo[1:]
+        for k, v := range d {
+            if v.dependencies.Contains(node) && set.Add(k) && transitive {
+                todo = append(todo, k)
+            }
+        }
+    }
+
+    set.Remove(name)
+
+    return set.Slice()
+}
+
+// shortest chain of imports from -> .. -> to, nil if none
+func (d Dag) Path(from, to string) []string {
+
+    previous := make(map[string]string)
+    todo := []string{from}
+    seen := stringset.New()
+    seen.Add(from)
+
+    for len(todo) > 0 {
+
+        node := todo[0]
+        todo = todo[1:]
+
+        if node == to {
+            chain := []string{to}
+            for node != from {
+                node = previous[node]
+                chain = append([]string{node}, chain...)
+            }
+            return chain
+        }
+
+        if p, ok := d[node]; ok {
+            deps := p.dependencies.Slice()
+            for i := 0; i < len(deps); i++ {
+                if seen.Add(deps[i]) {
+                    previous[deps[i]] = node
+                    todo = append(todo, deps[i])
+                }
+            }
+        }
+    }
+
+    return nil
+}
+
+func (d Dag) Leaves() []string {
+
+    leaves := make([]string, 0)
+
+    for _, k := range d.names() {
+        v := d[k]
+        leaf := true
+        for dep := range v.dependencies.Iter() {
+            if d.localDependency(dep) && dep != k {
+                leaf = false
+            }
+        }
+        if leaf {
+            leaves = append(leaves, k)
+        }
+    }
+
+    return leaves
+}
+
+func (d Dag) Roots() []string {
+
+    imported := stringset.New()
+
+    for k, v := range d {
+        for dep := range v.dependencies.Iter() {
+            if dep != k {
+                imported.Add(dep)
+            }
+        }
+    }
+
+    roots := make([]string, 0)
+
+    for _, k := range d.names() {
+        if !imported.Contains(k) {
+            roots = append(roots, k)
+        }
+    }
+
+    return roots
+}
+
+// packages containing one of the files, and every
+// local package depending on those (transitively)
+func (d Dag) Affected(files []string) []string {
+
+    changed := stringset.New()
+
+    for i := 0; i < len(files); i++ {
+        changed.Add(absPath(files[i]))
+    }
+
+    set := stringset.New()
+
+    for k, v := range d {
+        for i := 0; i < len(v.Files); i++ {
+            if changed.Contains(absPath(v.Files[i])) {
+                set.Add(k)
+            }
+        }
+    }
+
+    direct := set.Slice()
+
+    for i := 0; i < len(direct); i++ {
+        rdeps := d.RDeps(direct[i], true)
+        for j := 0; j < len(rdeps); j++ {
+            set.Add(rdeps[j])
+        }
+    }
+
+    return set.Slice()
+}
+
+func absPath(pathname string) string {
+    if filepath.IsAbs(pathname) {
+        return filepath.Clean(pathname)
+    }
+    pwd, e := os.Getwd()
+    if e != nil {
+        log.Fatal("[ERROR] could not locate working directory\n")
+    }
+    return filepath.Join(pwd, pathname)
+}
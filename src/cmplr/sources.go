@@ -0,0 +1,268 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package compiler
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "exec"
+    "sort"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/global"
+    "utilz/handy"
+    "cmplr/dag"
+)
+
+// Assembly (.s) and C (.c) files of a package are compiled next to
+// the Go object and packed into the package archive with it (main
+// packages: linked as loose objects):
+//
+//  gc     .s  6a -I $GOROOT/pkg/GOOS_GOARCH      (5a, 8a)
+//         .c  6c -FVw -I $GOROOT/pkg/GOOS_GOARCH (5c, 8c)
+//  gccgo  .s  gcc -c
+//         .c  gcc -c
+//
+// C files of cgo packages are compiled with gcc and the #cgo CFLAGS.
+
+var pathAsm string // gc: assembler (6a, 8a, 5a)
+
+func sourceTools() {
+
+    var err os.Error
+
+    switch suffix {
+    case ".o":
+        if pathGcc == "" {
+            if pathGcc, err = exec.LookPath("gcc"); err != nil {
+                log.Fatalf("[ERROR] %s\n", err)
+            }
+        }
+    case ".5", ".6", ".8":
+        A, C := suffix[1:]+"a", suffix[1:]+"c"
+        if pathAsm == "" {
+            if pathAsm, err = exec.LookPath(A); err != nil {
+                log.Fatalf("[ERROR] could not find assembler: %s\n", A)
+            }
+        }
+        if pathCc == "" {
+            if pathCc, err = exec.LookPath(C); err != nil {
+                log.Fatalf("[ERROR] could not find C compiler: %s\n", C)
+            }
+        }
+    default:
+        log.Fatalf("[ERROR] %s: .s/.c files not supported by backend\n", suffix)
+    }
+
+    if pathPacker == "" {
+        packer()
+    }
+}
+
+// steps which compile the .s/.c files of pkg into work, and the
+// objects they produce
+func sourceSteps(pkg *dag.Package, work string, cflags []string) ([]step, []string) {
+
+    steps := make([]step, 0)
+    objects := make([]string, 0)
+
+    for i := 0; i < len(pkg.Sources); i++ {
+
+        var argv []string
+
+        source := pkg.Sources[i]
+        base := filepath.Base(source)
+        base = base[:len(base)-len(filepath.Ext(base))]
+
+        // numbered, x.s and x.c may both be there
+        object := filepath.Join(work, fmt.Sprintf("_%d_%s", i, base))
+
+        switch {
+        case suffix == ".o" || (pkg.Cgo() && strings.HasSuffix(source, ".c")):
+            object += ".o"
+            argv = []string{pathGcc}
+            if suffix != ".o" {
+                argv = append(argv, gccArch()...)
+            }
+            argv = append(argv, "-fPIC", "-O2", "-c", "-I", filepath.Dir(source))
+            argv = append(argv, cflags...)
+        case strings.HasSuffix(source, ".s"):
+            object += suffix
+            argv = []string{pathAsm, "-I", stdlib}
+        default:
+            object += suffix
+            argv = []string{pathCc, "-FVw", "-I", stdlib}
+        }
+
+        argv = append(argv, "-o", object, source)
+
+        steps = append(steps, step{argv: argv})
+        objects = append(objects, object)
+    }
+
+    return steps, objects
+}
+
+// Main packages are never packed (nothing would pull main.main out
+// of an archive), the Go object is written to output and the other
+// objects are left loose in objdir, for ForkLink to link directly.
+// Packages are compiled into work and packed into output.
+
+// directory of the loose objects of main package object
+func looseDir(object string) string {
+    return object + ".d"
+}
+
+// loose objects (sorted) to link with main package object
+func looseObjects(object string) []string {
+    objects := regularFiles(looseDir(object), nil)
+    sort.SortStrings(objects)
+    return objects
+}
+
+// main packages with .s/.c files or cgo have loose objects
+func hasLoose(pkg *dag.Package) bool {
+    return !packed(pkg) && (pkg.Cgo() || len(pkg.Sources) > 0)
+}
+
+// argv compiles the Go files (-o is replaced), prefix: gccgo
+// symbol prefix (cgo must know it as well), "" if none
+func buildSteps(pkg *dag.Package, argv []string, output, work, objdir, prefix string) []step {
+
+    var steps []step
+    var objects []string
+
+    goObject := filepath.Join(work, "_go_"+suffix)
+
+    if !packed(pkg) {
+        goObject = output
+    }
+
+    if pkg.Cgo() {
+        steps, objects = cgoSteps(pkg, argv, goObject, work, objdir, prefix)
+    } else {
+        steps = []step{step{argv: withOutput(argv, goObject)}}
+        sources, sourceObjects := sourceSteps(pkg, objdir, nil)
+        steps = append(steps, sources...)
+        objects = append([]string{goObject}, sourceObjects...)
+    }
+
+    if !packed(pkg) {
+        return steps
+    }
+
+    packer := packArgv(output, objects[0])
+    packer = append(packer, objects[1:]...)
+
+    return append(steps, step{argv: packer})
+}
+
+// build pkg into output (Go object or archive), objdir is where loose
+// objects of a main package go, returns output and success
+func buildPackage(pkg *dag.Package, argv []string, output, objdir, prefix string) ([]byte, bool) {
+
+    var buffer bytes.Buffer
+
+    if !packed(pkg) && !hasLoose(pkg) {
+        argv = withOutput(argv, output)
+        if global.GetBool("-hermetic") {
+            return hermetic(argv, compileInputs(pkg), output)
+        }
+        return handy.Capture(argv)
+    }
+
+    work, e := ioutil.TempDir("", "gd-build")
+
+    if e != nil {
+        return []byte(fmt.Sprintf("[ERROR] %s\n", e)), false
+    }
+
+    handy.Partial(work)
+    defer handy.Complete(work)
+    defer os.RemoveAll(work)
+
+    // cgo names its output after the files given, so it
+    // runs in work where they are linked to by base name
+    for i := 0; i < len(pkg.CgoFiles); i++ {
+        link := filepath.Join(work, filepath.Base(pkg.CgoFiles[i]))
+        if e = os.Symlink(absPath(pkg.CgoFiles[i]), link); e != nil {
+            return []byte(fmt.Sprintf("[ERROR] %s\n", e)), false
+        }
+    }
+
+    if packed(pkg) {
+        objdir = work
+    } else {
+        os.RemoveAll(objdir)
+        if e = os.MkdirAll(objdir, 0777); e != nil {
+            return []byte(fmt.Sprintf("[ERROR] %s\n", e)), false
+        }
+    }
+
+    steps := buildSteps(pkg, argv, output, work, objdir, prefix)
+
+    // -hermetic: only the Go compile
+    if global.GetBool("-hermetic") && !pkg.Cgo() {
+        goObject := output
+        if packed(pkg) {
+            goObject = filepath.Join(work, "_go_"+suffix)
+        }
+        out, ok := hermetic(steps[0].argv, compileInputs(pkg), goObject)
+        buffer.Write(out)
+        if !ok {
+            return buffer.Bytes(), false
+        }
+        steps = steps[1:]
+    }
+
+    for i := 0; i < len(steps); i++ {
+        if !runStep(steps[i], &buffer) {
+            return buffer.Bytes(), false
+        }
+    }
+
+    return buffer.Bytes(), true
+}
+
+// -dryrun: print what buildPackage would do
+func printBuild(pkg *dag.Package, argv []string, output, objdir, prefix string) {
+
+    steps := make([]step, 0)
+
+    for i := 0; i < len(pkg.CgoFiles); i++ {
+        ln := []string{"ln", "-s", absPath(pkg.CgoFiles[i]), "$WORK"}
+        steps = append(steps, step{argv: ln})
+    }
+
+    if packed(pkg) {
+        objdir = "$WORK"
+    } else {
+        steps = append(steps, step{argv: []string{"mkdir", "-p", objdir}})
+    }
+
+    printSteps(append(steps, buildSteps(pkg, argv, output, "$WORK", objdir, prefix)...))
+}
+
+// -dryrun: steps as a shell script, with a temporary $WORK
+func printSteps(steps []step) {
+
+    fmt.Printf("WORK=$(mktemp -d)\n")
+
+    for i := 0; i < len(steps); i++ {
+        command := strings.Join(steps[i].argv, " ")
+        if steps[i].stdout != "" {
+            command += " > " + steps[i].stdout
+        }
+        if steps[i].dir != "" {
+            command = fmt.Sprintf("(cd %s && %s)", steps[i].dir, command)
+        }
+        fmt.Printf("%s || exit 1\n", command)
+    }
+
+    fmt.Printf("rm -rf $WORK\n")
+}
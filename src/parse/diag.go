@@ -0,0 +1,193 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package diag
+
+/*
+
+Compiler diagnostics come in slightly different shapes:
+
+ gc    :  dir/file.go:12: undefined: x
+ gccgo :  /abs/dir/file.go:12:5: error: reference to undefined name 'x'
+
+This package parses both into file, line, column and message,
+rewrites the path relative to the current directory (so that
+editors can jump to it), adds the offending line of source with
+a caret below it, and drops diagnostics that were already seen.
+
+*/
+
+import (
+    "os"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "utilz/stringset"
+)
+
+type Diagnostic struct {
+    File         string
+    Line, Column int // Column == 0 if unknown
+    Message      string
+}
+
+var diagRegex = regexp.MustCompile("^([^ :]+):([0-9]+):([0-9]+:)? *(.*)$")
+
+var sourceSuffixes = []string{".go", ".c", ".h", ".s"}
+
+// nil if line is not a diagnostic
+func Parse(line string) *Diagnostic {
+
+    m := diagRegex.FindStringSubmatch(line)
+
+    if m == nil || !sourceFile(m[1]) {
+        return nil
+    }
+
+    d := new(Diagnostic)
+    d.File = m[1]
+    d.Line, _ = strconv.Atoi(m[2])
+
+    if m[3] != "" {
+        d.Column, _ = strconv.Atoi(m[3][:len(m[3])-1])
+    }
+
+    d.Message = strings.TrimSpace(m[4])
+
+    return d
+}
+
+func sourceFile(pathname string) bool {
+    for i := 0; i < len(sourceSuffixes); i++ {
+        if strings.HasSuffix(pathname, sourceSuffixes[i]) {
+            return true
+        }
+    }
+    return false
+}
+
+func (d *Diagnostic) String() string {
+    if d.Column > 0 {
+        return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+    }
+    return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+// make File (if absolute) relative to dir, with ../ for each
+// directory of dir that File is not below
+func (d *Diagnostic) Relative(dir string) {
+
+    if !filepath.IsAbs(d.File) || !filepath.IsAbs(dir) {
+        return
+    }
+
+    sep := string(filepath.Separator)
+    file := strings.Split(filepath.Clean(d.File), sep, -1)
+    base := strings.Split(filepath.Clean(dir), sep, -1)
+
+    if filepath.Clean(dir) == sep {
+        base = []string{""}
+    }
+
+    common := 0
+
+    for common < len(base) && common < len(file)-1 &&
+        base[common] == file[common] {
+        common++
+    }
+
+    rel := make([]string, 0)
+
+    for i := common; i < len(base); i++ {
+        rel = append(rel, "..")
+    }
+
+    rel = append(rel, file[common:]...)
+
+    d.File = strings.Join(rel, sep)
+}
+
+// the offending line of source, with a caret below the column
+func (d *Diagnostic) Context() string {
+
+    b, e := ioutil.ReadFile(d.File)
+
+    if e != nil {
+        return ""
+    }
+
+    lines := strings.Split(string(b), "\n", -1)
+
+    if d.Line < 1 || d.Line > len(lines) {
+        return ""
+    }
+
+    source := strings.TrimRight(lines[d.Line-1], " \t\r")
+
+    if source == "" {
+        return ""
+    }
+
+    // without a column, point at the first non-blank
+    column := d.Column
+    if column == 0 {
+        column = len(source) - len(strings.TrimLeft(source, " \t")) + 1
+    }
+
+    caret := make([]byte, 0)
+
+    for i := 0; i < column-1 && i < len(source); i++ {
+        if source[i] == '\t' {
+            caret = append(caret, '\t')
+        } else {
+            caret = append(caret, ' ')
+        }
+    }
+
+    return fmt.Sprintf("    %s\n    %s^\n", source, string(caret))
+}
+
+// Rewrite compiler output: paths relative to current directory,
+// source context added, and diagnostics present in seen dropped.
+// Lines that are not diagnostics are passed through untouched.
+func Rewrite(output string, seen *stringset.StringSet) string {
+
+    cwd, e := os.Getwd()
+
+    if e != nil {
+        cwd = ""
+    }
+
+    result := make([]string, 0)
+    lines := strings.Split(output, "\n", -1)
+
+    for i := 0; i < len(lines); i++ {
+
+        d := Parse(lines[i])
+
+        if d == nil {
+            result = append(result, lines[i])
+            continue
+        }
+
+        if cwd != "" {
+            d.Relative(cwd)
+        }
+
+        if !seen.Add(d.String()) {
+            continue
+        }
+
+        result = append(result, d.String())
+
+        if context := d.Context(); context != "" {
+            result = append(result, strings.TrimRight(context, "\n"))
+        }
+    }
+
+    return strings.Join(result, "\n")
+}
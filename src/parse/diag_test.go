@@ -0,0 +1,110 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package diag_test
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "parse/diag"
+    "utilz/stringset"
+)
+
+func TestDiag(t *testing.T) {
+
+    d := diag.Parse("parse/gopt.go:12: undefined: x")
+
+    if d == nil {
+        t.Fatal("diag.Parse() missed gc diagnostic\n")
+    }
+
+    if d.File != "parse/gopt.go" || d.Line != 12 || d.Column != 0 {
+        t.Fatalf("diag.Parse() wrong position: %s\n", d)
+    }
+
+    if d.Message != "undefined: x" {
+        t.Fatalf("diag.Parse() wrong message: '%s'\n", d.Message)
+    }
+
+    d = diag.Parse("/home/u/src/parse/gopt.go:12:5: error: reference to undefined name 'x'")
+
+    if d == nil {
+        t.Fatal("diag.Parse() missed gccgo diagnostic\n")
+    }
+
+    if d.Line != 12 || d.Column != 5 {
+        t.Fatalf("diag.Parse() wrong position: %s\n", d)
+    }
+
+    d.Relative("/home/u")
+
+    if d.File != "src/parse/gopt.go" {
+        t.Fatalf("diagnostic.Relative() = %s\n", d.File)
+    }
+
+    if d.String() != "src/parse/gopt.go:12:5: error: reference to undefined name 'x'" {
+        t.Fatalf("diagnostic.String() = %s\n", d)
+    }
+
+    d = diag.Parse("/home/v/gopt.go:1: syntax error")
+    d.Relative("/home/u/src")
+
+    if d.File != "../../v/gopt.go" {
+        t.Fatalf("diagnostic.Relative() = %s\n", d.File)
+    }
+
+    if diag.Parse("[ERROR] exit status 1") != nil {
+        t.Fatal("diag.Parse() accepted non-diagnostic\n")
+    }
+
+    if diag.Parse("gopt.6:1: not a source file") != nil {
+        t.Fatal("diag.Parse() accepted object file\n")
+    }
+}
+
+func TestRewrite(t *testing.T) {
+
+    dir, e := ioutil.TempDir("", "gd-diag")
+
+    if e != nil {
+        t.Fatalf("%s\n", e)
+    }
+
+    defer os.RemoveAll(dir)
+
+    file := filepath.Join(dir, "x.go")
+    e = ioutil.WriteFile(file, []byte("package x\n\tvar y = z\n"), 0644)
+
+    if e != nil {
+        t.Fatalf("%s\n", e)
+    }
+
+    line := file + ":2:10: error: reference to undefined name 'z'"
+    seen := stringset.New()
+
+    output := diag.Rewrite(line+"\n"+line+"\n", seen)
+    lines := strings.Split(output, "\n", -1)
+
+    // diagnostic, source, caret, "" (the final newline)
+    if len(lines) != 4 || strings.Count(output, "undefined name") != 1 {
+        t.Fatalf("diag.Rewrite() did not drop duplicate:\n%s\n", output)
+    }
+
+    if lines[1] != "    \tvar y = z" {
+        t.Fatalf("diag.Rewrite() wrong source line: '%s'\n", lines[1])
+    }
+
+    if lines[2] != "    \t        ^" {
+        t.Fatalf("diag.Rewrite() wrong caret line: '%s'\n", lines[2])
+    }
+
+    output = diag.Rewrite(line, seen)
+
+    if strings.TrimSpace(output) != "" {
+        t.Fatalf("diag.Rewrite() repeated seen diagnostic:\n%s\n", output)
+    }
+}
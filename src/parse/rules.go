@@ -0,0 +1,147 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package rules
+
+/*
+
+Rules restrict which packages are allowed to import
+which, one rule per line, '#' starts a comment.
+
+ utilz/*  must not import  cmplr/*
+ parse    must not import  cmplr
+ start -> cmplr -> utilz
+
+A pattern is a glob (path.Match), a plain package path
+also matches everything below it, i.e. 'cmplr' matches
+both 'cmplr' and 'cmplr/dag'.
+
+A chain of layers gives the allowed direction of imports,
+a layer may import layers to its right, never to its left,
+i.e. 'utilz' must not import 'cmplr' nor 'start' above.
+
+*/
+
+import (
+    "os"
+    "fmt"
+    "path"
+    "strings"
+    "io/ioutil"
+)
+
+type Rule struct {
+    From, To string // patterns
+    Text     string // rule as written in file
+    Line     int
+}
+
+func (r *Rule) Forbids(from, to string) bool {
+    return Match(r.From, from) && Match(r.To, to)
+}
+
+func (r *Rule) String() string {
+    return fmt.Sprintf("'%s' (line %d)", r.Text, r.Line)
+}
+
+// Returns the first rule forbidding: from -> to, nil if legal
+func Check(rs []*Rule, from, to string) *Rule {
+    for i := 0; i < len(rs); i++ {
+        if rs[i].Forbids(from, to) {
+            return rs[i]
+        }
+    }
+    return nil
+}
+
+func Match(pattern, pkg string) bool {
+    if strings.HasPrefix(pkg, pattern+"/") {
+        return true
+    }
+    ok, _ := path.Match(pattern, pkg)
+    return ok
+}
+
+func ParseFile(filename string) ([]*Rule, os.Error) {
+
+    b, e := ioutil.ReadFile(filename)
+
+    if e != nil {
+        return nil, e
+    }
+
+    return Parse(string(b))
+}
+
+func Parse(content string) ([]*Rule, os.Error) {
+
+    rs := make([]*Rule, 0)
+    lines := strings.Split(content, "\n", -1)
+
+    for i := 0; i < len(lines); i++ {
+
+        line := lines[i]
+
+        if j := strings.Index(line, "#"); j >= 0 {
+            line = line[:j]
+        }
+
+        fields := strings.Fields(line)
+
+        if len(fields) == 0 {
+            continue
+        }
+
+        if len(fields) == 5 &&
+            fields[1] == "must" && fields[2] == "not" && fields[3] == "import" {
+            r := new(Rule)
+            r.From = fields[0]
+            r.To = fields[4]
+            r.Text = strings.Join(fields, " ")
+            r.Line = i + 1
+            rs = append(rs, r)
+        } else if layers, ok := chain(fields); ok {
+            for j := 1; j < len(layers); j++ {
+                for k := 0; k < j; k++ {
+                    r := new(Rule)
+                    r.From = layers[j]
+                    r.To = layers[k]
+                    r.Text = strings.Join(fields, " ")
+                    r.Line = i + 1
+                    rs = append(rs, r)
+                }
+            }
+        } else {
+            return nil, os.NewError(fmt.Sprintf("[parse/rules] line %d: "+
+                "expected 'A must not import B' or 'A -> B -> C'", i+1))
+        }
+    }
+
+    return rs, nil
+}
+
+// A -> B -> C  =>  [A, B, C]
+func chain(fields []string) ([]string, bool) {
+
+    if len(fields) < 3 || len(fields)%2 == 0 {
+        return nil, false
+    }
+
+    layers := make([]string, 0)
+
+    for i := 0; i < len(fields); i++ {
+        if i%2 == 1 {
+            if fields[i] != "->" {
+                return nil, false
+            }
+        } else {
+            if fields[i] == "->" {
+                return nil, false
+            }
+            layers = append(layers, fields[i])
+        }
+    }
+
+    return layers, true
+}
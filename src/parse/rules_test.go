@@ -0,0 +1,79 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package rules_test
+
+import (
+    "testing"
+    "parse/rules"
+)
+
+func TestRules(t *testing.T) {
+
+    content := `
+# utilities should not know about the compiler
+utilz/*  must not import  cmplr/*
+parse    must not import  cmplr   # nor should the parser
+`
+
+    rs, e := rules.Parse(content)
+
+    if e != nil {
+        t.Fatalf("rules.Parse() error = %s\n", e)
+    }
+
+    if len(rs) != 2 {
+        t.Fatalf("len(rules) != 2 (%d)\n", len(rs))
+    }
+
+    if rs[0].Line != 3 || rs[1].Line != 4 {
+        t.Fatal("rules.Parse() wrong line numbers\n")
+    }
+
+    if rules.Check(rs, "utilz/handy", "cmplr/dag") != rs[0] {
+        t.Fatal("utilz/handy -> cmplr/dag should violate rule 1\n")
+    }
+
+    if rules.Check(rs, "parse/gopt", "cmplr/compiler") != rs[1] {
+        t.Fatal("parse/gopt -> cmplr/compiler should violate rule 2\n")
+    }
+
+    if rules.Check(rs, "cmplr/dag", "utilz/handy") != nil {
+        t.Fatal("cmplr/dag -> utilz/handy should be legal\n")
+    }
+
+    if rules.Check(rs, "parser/gopt", "cmplr/dag") != nil {
+        t.Fatal("'parse' should not match 'parser/gopt'\n")
+    }
+
+    rs, e = rules.Parse("start -> cmplr -> utilz\n")
+
+    if e != nil {
+        t.Fatalf("rules.Parse() error = %s\n", e)
+    }
+
+    if rules.Check(rs, "utilz/handy", "cmplr/dag") == nil {
+        t.Fatal("utilz/handy -> cmplr/dag should violate layering\n")
+    }
+
+    if rules.Check(rs, "utilz/handy", "start/main") == nil {
+        t.Fatal("utilz/handy -> start/main should violate layering\n")
+    }
+
+    if rules.Check(rs, "start/main", "utilz/handy") != nil {
+        t.Fatal("start/main -> utilz/handy should be legal\n")
+    }
+
+    _, e = rules.Parse("utilz imports cmplr\n")
+
+    if e == nil {
+        t.Fatal("rules.Parse() accepted malformed rule\n")
+    }
+
+    _, e = rules.Parse("utilz -> -> cmplr\n")
+
+    if e == nil {
+        t.Fatal("rules.Parse() accepted malformed layering\n")
+    }
+}
@@ -9,16 +9,24 @@ import (
     "fmt"
     "log"
     "strings"
+    "sort"
+    "strconv"
     "runtime"
+    "bytes"
+    "exec"
+    "os/signal"
+    "io/ioutil"
     "path/filepath"
     "utilz/walker"
     "cmplr/compiler"
     "cmplr/dag"
     "parse/gopt"
+    "parse/rules"
     "utilz/handy"
     "utilz/global"
     "utilz/timer"
     "utilz/say"
+    "utilz/cache"
 )
 
 
@@ -34,6 +42,19 @@ var includes []string = nil
 // source root
 var srcdir string = "."
 
+// sub-commands: gd [OPTIONS] [src-directory] command [arguments]
+var commands = []string{
+    "query",
+    "cache",
+    "verify-repro",
+    "install",
+    "uninstall",
+}
+
+// sub-command given (if any) and its arguments
+var command string = ""
+var commandArgs []string
+
 
 // keys for the bool options
 var bools = []string{
@@ -51,6 +72,20 @@ var bools = []string{
     "-quiet",
     "-tab",
     "-external",
+    "-lint-imports",
+    "-check-rules",
+    "-dot-nostd",
+    "-dot-noext",
+    "-dot-cluster",
+    "-dot-color",
+    "-dot-reduce",
+    "-transitive",
+    "-json",
+    "-critical",
+    "-hermetic",
+    "-reproducible",
+    "-keep-work",
+    "-pack",
 }
 
 // keys for the string options
@@ -68,6 +103,20 @@ var strs = []string{
     "-main",
     "-backend",
     "-exclude",
+    "-rules",
+    "-dot-label",
+    "-dot-focus",
+    "-dot-depth",
+    "-graph",
+    "-graph-fmt",
+    "-since",
+    "-cache",
+    "-cache-url",
+    "-cache-max",
+    "-log-dir",
+    "-timings",
+    "-prefix",
+    "-link-mode",
 }
 
 
@@ -91,6 +140,20 @@ func init() {
     getopt.BoolOption("-f -fmt --fmt")
     getopt.BoolOption("-tab --tab")
     getopt.BoolOption("-e -external --external")
+    getopt.BoolOption("-lint-imports --lint-imports")
+    getopt.BoolOption("-check-rules --check-rules")
+    getopt.BoolOption("-dot-nostd --dot-nostd")
+    getopt.BoolOption("-dot-noext --dot-noext")
+    getopt.BoolOption("-dot-cluster --dot-cluster")
+    getopt.BoolOption("-dot-color --dot-color")
+    getopt.BoolOption("-dot-reduce --dot-reduce")
+    getopt.BoolOption("-transitive --transitive")
+    getopt.BoolOption("-json --json")
+    getopt.BoolOption("-critical --critical")
+    getopt.BoolOption("-hermetic --hermetic")
+    getopt.BoolOption("-reproducible --reproducible")
+    getopt.BoolOption("-keep-work --keep-work")
+    getopt.BoolOption("-pack --pack")
     getopt.StringOption("-a -a= -arch --arch -arch= --arch=")
     getopt.StringOption("-dot -dot= --dot --dot=")
     getopt.StringOption("-L -L= -lib -lib= --lib --lib=")
@@ -104,6 +167,20 @@ func init() {
     getopt.StringOption("-test-bin --test-bin -test-bin= --test-bin=")
     getopt.StringOption("-B -B= -backend --backend -backend= --backend=")
     getopt.StringOption("-x -x= -exclude --exclude --exclude=")
+    getopt.StringOption("-rules -rules= --rules --rules=")
+    getopt.StringOption("-dot-label -dot-label= --dot-label --dot-label=")
+    getopt.StringOption("-dot-focus -dot-focus= --dot-focus --dot-focus=")
+    getopt.StringOption("-dot-depth -dot-depth= --dot-depth --dot-depth=")
+    getopt.StringOption("-graph -graph= --graph --graph=")
+    getopt.StringOption("-graph-fmt -graph-fmt= --graph-fmt --graph-fmt=")
+    getopt.StringOption("-since -since= --since --since=")
+    getopt.StringOption("-cache -cache= --cache --cache=")
+    getopt.StringOption("-cache-url -cache-url= --cache-url --cache-url=")
+    getopt.StringOption("-cache-max -cache-max= --cache-max --cache-max=")
+    getopt.StringOption("-log-dir -log-dir= --log-dir --log-dir=")
+    getopt.StringOption("-timings -timings= --timings --timings=")
+    getopt.StringOption("-prefix -prefix= --prefix --prefix=")
+    getopt.StringOption("-link-mode -link-mode= --link-mode --link-mode=")
 
     // override IncludeFile to make walker pick up only .go files
     walker.IncludeFile = func(s string) bool {
@@ -164,6 +241,8 @@ func main() {
     timer.Start("everything")
     defer reportTime()
 
+    go trapSignals()
+
     // default config location 1 $HOME/.gdrc
     config1 = filepath.Join(os.Getenv("HOME"), ".gdrc")
     argv, ok = handy.ConfigToArgv(config1)
@@ -188,6 +267,14 @@ func main() {
 
     // command line arguments overrides/appends config
     args = parseArgv(os.Args[1:])
+    command, commandArgs, args = splitCommand(args)
+
+    // these take no arguments, src-directory may follow them
+    switch command {
+    case "install", "uninstall", "verify-repro":
+        args = append(args, commandArgs...)
+        commandArgs = nil
+    }
 
     if len(args) > 0 {
         if len(args) > 1 {
@@ -213,6 +300,23 @@ func main() {
     // expand variables in -output
     global.SetString("-output", os.ShellExpand(global.GetString("-output")))
 
+    // expand variables in -cache
+    global.SetString("-cache", os.ShellExpand(global.GetString("-cache")))
+
+    // expand variables in -log-dir
+    global.SetString("-log-dir", os.ShellExpand(global.GetString("-log-dir")))
+
+    // expand variables in -timings
+    global.SetString("-timings", os.ShellExpand(global.GetString("-timings")))
+
+    // expand variables in -prefix
+    global.SetString("-prefix", os.ShellExpand(global.GetString("-prefix")))
+
+    if (command == "install" || command == "uninstall") &&
+        global.GetString("-prefix") == "" {
+        log.Fatalf("[ERROR] %s: missing -prefix\n", command)
+    }
+
     // stuff that can be done without $GOROOT
     if global.GetBool("-list") {
         printListing()
@@ -229,6 +333,16 @@ func main() {
         os.Exit(0)
     }
 
+    if command == "cache" {
+        cacheCommand(commandArgs)
+        os.Exit(0)
+    }
+
+    if command == "verify-repro" {
+        verifyRepro()
+        os.Exit(0)
+    }
+
     if len(args) == 0 {
         // give nice feedback if missing input dir
         cwd, e := os.Getwd()
@@ -248,11 +362,29 @@ func main() {
         say.Mute()
     }
 
+    if command == "uninstall" {
+        compiler.Uninstall(global.GetString("-prefix"), projectName())
+        os.Exit(0)
+    }
+
     // delete all object/archive files
     if global.GetBool("-clean") {
+        handy.DirOrExit(srcdir)
+        // archives are known by the packages they hold
+        dgrph := dag.New()
+        dgrph.Parse(srcdir, walker.PathWalk(filepath.Clean(srcdir)))
+        dgrph.AddSources(sourceFiles())
+        compiler.RemoveArchives(srcdir, dgrph)
+        // objects for -link-mode c-shared (without -lib)
+        pic := filepath.Join(srcdir, "_pic")
+        if handy.IsDir(pic) {
+            compiler.RemoveArchives(pic, dgrph)
+            compiler.Remove865o(pic, true)
+        }
         compiler.Remove865o(srcdir, false) // do not remove dir
         if global.GetString("-lib") != "" {
             if handy.IsDir(global.GetString("-lib")) {
+                compiler.RemoveArchives(global.GetString("-lib"), dgrph)
                 compiler.Remove865o(global.GetString("-lib"), true)
             }
         }
@@ -271,6 +403,13 @@ func main() {
     // parse the source code, look for dependencies
     dgrph := dag.New()
     dgrph.Parse(srcdir, files)
+    dgrph.AddSources(sourceFiles())
+
+    // answer questions about the package graph
+    if command == "query" {
+        dgrph.Query(commandArgs, global.GetBool("-transitive"), global.GetBool("-json"))
+        os.Exit(0)
+    }
 
     // print collected dependency info
     if global.GetBool("-print") {
@@ -278,12 +417,38 @@ func main() {
         os.Exit(0)
     }
 
+    // report unused, duplicate, dead and illegal imports
+    if global.GetBool("-lint-imports") {
+        if dgrph.LintImports(loadRules()) > 0 {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    // only check dependencies against -rules (pre-commit hooks)
+    if global.GetBool("-check-rules") {
+        if global.GetString("-rules") == "" {
+            log.Fatal("[ERROR] --check-rules requires --rules\n")
+        }
+        dgrph.GraphBuilder()
+        if !dgrph.CheckLayers(loadRules()) {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
     // draw graphviz dot graph
     if global.GetString("-dot") != "" {
         dgrph.MakeDotGraph(global.GetString("-dot"))
         os.Exit(0)
     }
 
+    // export graph as graphml, json, mermaid, html or svg
+    if global.GetString("-graph") != "" {
+        dgrph.MakeGraph(global.GetString("-graph"), global.GetString("-graph-fmt"))
+        os.Exit(0)
+    }
+
     gotRoot() //? (only matters to gc, gccgo and express ignores it)
 
     // build &| update all external dependencies
@@ -294,6 +459,13 @@ func main() {
 
     // sort graph based on dependencies
     dgrph.GraphBuilder()
+
+    if global.GetString("-rules") != "" {
+        if !dgrph.CheckLayers(loadRules()) {
+            log.Fatal("[ERROR] dependency graph violates -rules\n")
+        }
+    }
+
     sorted := dgrph.Topsort()
 
     // print packages sorted
@@ -304,56 +476,93 @@ func main() {
         os.Exit(0)
     }
 
+    // go:generate / gd:generate (build, test, install only),
+    // generated files are walked and the graph built again
+    if compiler.Generate(srcdir, files) {
+        files = walker.PathWalk(filepath.Clean(srcdir))
+        dgrph = dag.New()
+        dgrph.Parse(srcdir, files)
+        dgrph.AddSources(sourceFiles())
+        dgrph.GraphBuilder()
+        if global.GetString("-rules") != "" {
+            if !dgrph.CheckLayers(loadRules()) {
+                log.Fatal("[ERROR] dependency graph violates -rules\n")
+            }
+        }
+        sorted = dgrph.Topsort()
+    }
+
     // compile
     compiler.Init(srcdir, global.GetString("-arch"), includes)
+    compiler.InitLinkMode(sorted)
+    compiler.CheckImports(dgrph)
+    compiler.InitCache(newCache())
+
     if global.GetString("-lib") != "" {
         compiler.CreateLibArgv(sorted)
     } else {
         compiler.CreateArgv(sorted)
     }
 
+    compiler.RemoveStale(sorted)
+
     if runtime.GOMAXPROCS(-1) > 1 && !global.GetBool("-dryrun") {
         compiler.ParallelCompile(sorted)
     } else {
         compiler.SerialCompile(sorted)
     }
 
+    compiler.ReportTimings()
+    trimCache()
+
+    if global.GetBool("-critical") {
+        dgrph.PrintCriticalPath(compiler.Times())
+    }
+
+    if command == "install" {
+        compiler.Install(global.GetString("-prefix"), projectName(), sorted)
+        return
+    }
+
+    // only test packages affected by changes since -since
+    var affected []string = nil
+
+    if global.GetBool("-test") && global.GetString("-since") != "" {
+        affected = dgrph.Affected(changedFiles(global.GetString("-since")))
+        if len(affected) == 0 {
+            say.Printf("testing  : nothing changed since %s\n",
+                global.GetString("-since"))
+        }
+    }
+
     // test
-    if global.GetBool("-test") {
+    if global.GetBool("-test") && (affected == nil || len(affected) > 0) {
         os.Setenv("SRCROOT", srcdir)
-        testMain, testDir := dgrph.MakeMainTest(srcdir)
-        if global.GetString("-lib") != "" {
-            compiler.CreateLibArgv(testMain)
-        } else {
-            compiler.CreateArgv(testMain)
-        }
+        compiler.CompileMainTests(sorted)
+        testMain, testDir := dgrph.MakeMainTest(affected)
+        handy.AtExit(func() { removeWork(testMain, testDir) })
+        compiler.CreateTestMainArgv(testMain, testDir)
         compiler.SerialCompile(testMain)
-        switch global.GetString("-backend") {
-        case "gc","express":
-            compiler.ForkLink(global.GetString("-test-bin"), testMain, nil)
-        case "gccgo", "gcc":
-            compiler.ForkLink(global.GetString("-test-bin"), testMain, sorted)
-        default:
-            log.Fatalf("[ERROR] '%s' unknown back-end\n", global.GetString("-backend"))
-        }
-        compiler.DeletePackages(testMain)
-        rmError := os.Remove(testDir)
-        if rmError != nil {
-            log.Printf("[ERROR] failed to remove testdir: %s\n", testDir)
-        }
+        // sorted: linked by gccgo, inputs of -hermetic links
+        compiler.ForkLink(global.GetString("-test-bin"), testMain, sorted)
+        handy.Cleanup()
         testArgv := compiler.CreateTestArgv()
         if !global.GetBool("-dryrun") {
             say.Printf("testing  : ")
             if global.GetBool("-verbose"){
                 say.Printf("\n")
             }
+            // removed even if the test is interrupted
+            handy.AtExit(func() {
+                e := os.Remove(global.GetString("-test-bin"))
+                if e != nil {
+                    log.Printf("[ERROR] %s\n", e)
+                }
+            })
             ok = handy.StdExecve(testArgv, false)
-            e = os.Remove(global.GetString("-test-bin"))
-            if e != nil {
-                log.Printf("[ERROR] %s\n", e)
-            }
+            handy.Cleanup()
             if !ok {
-                os.Exit(1)
+                handy.Exit(1)
             }
         }else{
             say.Printf("%s\n", strings.Join(testArgv, " "))
@@ -367,6 +576,380 @@ func main() {
 }
 
 
+// SIGINT/SIGTERM: forward to children (compilers, linker, tests),
+// remove what they were writing and our temporary files, exit
+func trapSignals() {
+    for sig := range signal.Incoming {
+        if usig, ok := sig.(os.UnixSignal); ok {
+            if usig == os.SIGINT || usig == os.SIGTERM {
+                log.Printf("[ERROR] %s: stopping\n", sig)
+                handy.Interrupt(sig)
+                handy.Exit(128 + int(usig))
+            }
+        }
+    }
+}
+
+// .s and .c files below srcdir
+func sourceFiles() []string {
+
+    includeFile := walker.IncludeFile
+
+    walker.IncludeFile = func(s string) bool {
+        return strings.HasSuffix(s, ".s") || strings.HasSuffix(s, ".c")
+    }
+
+    files := walker.PathWalk(filepath.Clean(srcdir))
+    walker.IncludeFile = includeFile
+
+    return files
+}
+
+// name of manifest for install/uninstall: directory of the source
+// tree, the directory above it if that is just 'src' (proj/src)
+func projectName() string {
+
+    dir := filepath.Clean(srcdir)
+
+    if !filepath.IsAbs(dir) {
+        if cwd, e := os.Getwd(); e == nil {
+            dir = filepath.Join(cwd, dir)
+        }
+    }
+
+    if filepath.Base(dir) == "src" && len(filepath.Dir(dir)) > 1 {
+        dir = filepath.Dir(dir)
+    }
+
+    return filepath.Base(dir)
+}
+
+// remove generated test main (source, object and directories)
+// unless -keep-work is given, also called when gd exits early
+func removeWork(testMain []*dag.Package, testDir string) {
+
+    if global.GetBool("-keep-work") {
+        say.Printf("work dir : %s\n", testDir)
+        return
+    }
+
+    compiler.DeleteObjects(testMain)
+
+    e := os.RemoveAll(testDir)
+
+    if e != nil {
+        log.Printf("[ERROR] failed to remove testdir: %s\n", testDir)
+    }
+}
+
+// separate sub-command (+ arguments) from the source directory,
+// the command is either the first or the second argument
+func splitCommand(args []string) (cmd string, cmdArgs, rest []string) {
+
+    for i := 0; i < len(args) && i < 2; i++ {
+        for j := 0; j < len(commands); j++ {
+            if args[i] == commands[j] {
+                return args[i], args[i+1:], args[:i]
+            }
+        }
+    }
+
+    return "", nil, args
+}
+
+// files changed (according to git) since revision
+func changedFiles(revision string) []string {
+
+    top, e := handy.StdOutput([]string{"git", "rev-parse", "--show-toplevel"})
+
+    if e != nil {
+        log.Fatalf("[ERROR] git rev-parse: %s\n", e)
+    }
+
+    diff, e := handy.StdOutput([]string{"git", "diff", "--name-only", revision})
+
+    if e != nil {
+        log.Fatalf("[ERROR] git diff: %s\n", e)
+    }
+
+    root := strings.TrimSpace(string(top))
+    changed := make([]string, 0)
+
+    for _, name := range strings.Split(string(diff), "\n", -1) {
+        name = strings.TrimSpace(name)
+        if name != "" {
+            changed = append(changed, filepath.Join(root, name))
+        }
+    }
+
+    return changed
+}
+
+// size limit of local build cache (-cache-max MB) in bytes
+func cacheMax() int64 {
+
+    if global.GetString("-cache-max") == "" {
+        return 0
+    }
+
+    mb, e := strconv.Atoi64(global.GetString("-cache-max"))
+
+    if e != nil || mb < 0 {
+        log.Fatalf("[ERROR] -cache-max: %s\n", global.GetString("-cache-max"))
+    }
+
+    return mb * 1024 * 1024
+}
+
+// build cache from -cache and -cache-url, nil if none given
+func newCache() cache.Cache {
+
+    layers := make(cache.Layers, 0)
+
+    if global.GetString("-cache") != "" {
+        layers = append(layers, cache.NewDir(global.GetString("-cache")))
+    }
+
+    if global.GetString("-cache-url") != "" {
+        layers = append(layers, cache.NewHTTP(global.GetString("-cache-url")))
+    }
+
+    if len(layers) == 0 {
+        return nil
+    }
+
+    return layers
+}
+
+// apply -cache-max once the build has stored its objects
+func trimCache() {
+    if global.GetString("-cache") != "" && cacheMax() > 0 &&
+        !global.GetBool("-dryrun") {
+        cache.NewDir(global.GetString("-cache")).Trim(cacheMax())
+    }
+}
+
+// gd cache stats|trim|clear
+func cacheCommand(args []string) {
+
+    if global.GetString("-cache") == "" {
+        log.Fatal("[ERROR] cache: missing -cache directory\n")
+    }
+
+    if len(args) != 1 {
+        log.Fatal("[ERROR] cache: expected one of [stats,trim,clear]\n")
+    }
+
+    dir := cache.NewDir(global.GetString("-cache"))
+
+    switch args[0] {
+    case "stats":
+        objects, size := dir.Stats()
+        fmt.Printf("cache    : %s\n", global.GetString("-cache"))
+        fmt.Printf("objects  : %d\n", objects)
+        fmt.Printf("size     : %.2f MB\n", float64(size)/(1024*1024))
+        if cacheMax() > 0 {
+            fmt.Printf("limit    : %s MB\n", global.GetString("-cache-max"))
+        }
+    case "trim":
+        if cacheMax() == 0 {
+            log.Fatal("[ERROR] cache trim: missing -cache-max\n")
+        }
+        removed, freed := dir.Trim(cacheMax())
+        say.Printf("trim     : %d objects, %.2f MB\n",
+            removed, float64(freed)/(1024*1024))
+    case "clear":
+        if global.GetBool("-dryrun") {
+            fmt.Printf("[dryrun] rm: %s\n", global.GetString("-cache"))
+        } else {
+            e := dir.Clear()
+            if e != nil {
+                log.Fatalf("[ERROR] %s\n", e)
+            }
+            say.Printf("rm: %s\n", global.GetString("-cache"))
+        }
+    default:
+        log.Fatalf("[ERROR] cache: unknown command: %s\n", args[0])
+    }
+}
+
+// gd verify-repro: build twice with -reproducible into separate
+// -lib directories, compare objects and binaries byte for byte
+func verifyRepro() {
+
+    self, e := exec.LookPath(os.Args[0])
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    base, e := ioutil.TempDir("", "gd-repro")
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    builds := []string{filepath.Join(base, "1"), filepath.Join(base, "2")}
+
+    for i := 0; i < len(builds); i++ {
+
+        argv := []string{self}
+
+        // the first value of an option wins, so the user's
+        // values of the options set below are left out
+        for j := 1; j < len(os.Args); j++ {
+
+            drop, value := reproOverride(os.Args[j])
+
+            if drop {
+                if value {
+                    j++
+                }
+                continue
+            }
+
+            if os.Args[j] != "verify-repro" {
+                argv = append(argv, os.Args[j])
+            }
+        }
+
+        // build cache would hand out the objects of the first build
+        argv = append(argv, "-reproducible", "-lib", builds[i],
+            "-cache", "", "-cache-url", "")
+
+        binary := ""
+
+        if global.GetString("-output") != "" {
+            binary = filepath.Join(builds[i], filepath.Base(global.GetString("-output")))
+            argv = append(argv, "-output", binary)
+        }
+
+        say.Printf("build %d  : %s\n", i+1, builds[i])
+
+        if !handy.StdExecve(argv, false) {
+            os.RemoveAll(base)
+            log.Fatalf("[ERROR] verify-repro: build %d failed\n", i+1)
+        }
+
+        for _, expected := range []string{builds[i], binary} {
+            if _, e := os.Stat(expected); expected != "" && e != nil {
+                os.RemoveAll(base)
+                log.Fatalf("[ERROR] verify-repro: build %d: missing %s\n", i+1, expected)
+            }
+        }
+    }
+
+    first := treeFiles(builds[0], "", make(map[string]string))
+    second := treeFiles(builds[1], "", make(map[string]string))
+
+    differ := make([]string, 0)
+
+    for k, v := range first {
+        w, ok := second[k]
+        if !ok || !sameContent(v, w) {
+            differ = append(differ, k)
+        }
+    }
+
+    for k, _ := range second {
+        if _, ok := first[k]; !ok {
+            differ = append(differ, k)
+        }
+    }
+
+    os.RemoveAll(base)
+
+    if len(differ) > 0 {
+        sort.SortStrings(differ)
+        for i := 0; i < len(differ); i++ {
+            log.Printf("[ERROR] differs: %s\n", differ[i])
+        }
+        log.Fatalf("[ERROR] build is not reproducible, %d file(s) differ\n", len(differ))
+    }
+
+    say.Printf("verified : %d file(s) identical\n", len(first))
+}
+
+// options verify-repro sets for each build (and their forms)
+var reproOptions = []string{"-L", "-lib", "--lib", "-o", "-output", "--output",
+    "-cache", "--cache", "-cache-url", "--cache-url"}
+
+// drop: arg sets one of reproOptions, value: its value is the next arg
+func reproOverride(arg string) (drop, value bool) {
+
+    for i := 0; i < len(reproOptions); i++ {
+        if arg == reproOptions[i] {
+            return true, true
+        }
+        if strings.HasPrefix(arg, reproOptions[i]+"=") {
+            return true, false
+        }
+    }
+
+    // juxtaposed: -Ldir -ofile
+    if strings.HasPrefix(arg, "-L") ||
+        (strings.HasPrefix(arg, "-o") && !strings.HasPrefix(arg, "-output")) {
+        return true, false
+    }
+
+    return false, false
+}
+
+// relative path -> path of files below root, compile times
+// (.gd-times) are expected to differ between builds
+func treeFiles(root, rel string, files map[string]string) map[string]string {
+
+    entries, e := ioutil.ReadDir(filepath.Join(root, rel))
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    for i := 0; i < len(entries); i++ {
+        name := filepath.Join(rel, entries[i].Name)
+        if entries[i].IsDirectory() {
+            treeFiles(root, name, files)
+        } else if entries[i].IsRegular() && entries[i].Name != ".gd-times" {
+            files[name] = filepath.Join(root, name)
+        }
+    }
+
+    return files
+}
+
+func sameContent(a, b string) bool {
+
+    x, e := ioutil.ReadFile(a)
+
+    if e != nil {
+        return false
+    }
+
+    y, e := ioutil.ReadFile(b)
+
+    if e != nil {
+        return false
+    }
+
+    return bytes.Equal(x, y)
+}
+
+// rules given with -rules, nil if not set
+func loadRules() []*rules.Rule {
+
+    if global.GetString("-rules") == "" {
+        return nil
+    }
+
+    rs, e := rules.ParseFile(global.GetString("-rules"))
+
+    if e != nil {
+        log.Fatalf("[ERROR] %s\n", e)
+    }
+
+    return rs
+}
+
 func parseArgv(argv []string) (args []string) {
 
     args = getopt.Parse(argv)
@@ -412,6 +995,19 @@ func printHelp() {
   Hopefully it simplifies testing as well.
 
   usage: gd [OPTIONS] src-directory
+         gd [OPTIONS] [src-directory] query COMMAND [ARGS]
+         gd [OPTIONS] cache [stats,trim,clear]
+         gd [OPTIONS] [src-directory] verify-repro
+         gd -prefix DIR [OPTIONS] [src-directory] install|uninstall
+
+  query commands:
+
+  deps PKG             imports of PKG (--transitive)
+  rdeps PKG            packages importing PKG (--transitive)
+  path A B             shortest import chain from A to B
+  leaves               packages importing no local package
+  roots                packages not imported by anyone
+  affected FILE..      packages to rebuild/retest for FILE..
 
   options:
 
@@ -429,10 +1025,35 @@ func printHelp() {
   -L --lib             write objects to other dir (!src)
   -M --main            regex to select main package
   -dot                 create a graphviz dot file
+  --dot-nostd          hide standard library in dot file
+  --dot-noext          hide external packages in dot file
+  --dot-cluster        cluster packages by directory
+  --dot-color          colour main/test/library packages
+  --dot-label          annotate packages [files,lines]
+  --dot-reduce         draw transitive reduction only
+  --dot-focus          draw neighbourhood of package only
+  --dot-depth          size of neighbourhood (default: 1)
+  --graph              export graph (--dot-* filters apply)
+  --graph-fmt          [graphml,json,mermaid,html,svg] (default: suffix)
+  --transitive         query deps/rdeps transitively
+  --json               print query result as json
+  --cache              directory of local build cache
+  --cache-url          url of remote (http) build cache
+  --cache-max          size limit of local build cache (MB)
+  --log-dir            save compiler output for each package
+  --timings            write build trace (chrome://tracing)
+  --critical           print critical path of build
+  --hermetic           compile/link in sandbox, scrubbed env
+  --reproducible       normalise order, paths and env of build
+  --keep-work          keep generated test main (print where)
+  --pack               package archives (.a) instead of objects
+  --prefix             install/uninstall below this directory
+  --link-mode          [exe,c-archive,c-shared] or REGEX=MODE,..
   -I                   import package directories
   -t --test            run all unit-tests
   -b --bench           regex to select benchmarks
   -m --match           regex to select unit-tests
+  --since              only test packages affected since git rev
   -V --verbose         verbose unit-test and goinstall
   --test-bin           name of test-binary (default: gdtest)
   -f --fmt             run gofmt on src and exit
@@ -441,6 +1062,9 @@ func printHelp() {
   --tabwidth           pass -tabwidth to gofmt (default: 4)
   -e --external        goinstall all external dependencies
   -B --backend         [gc,gccgo,express] (default: gc)
+  --lint-imports       report unused/duplicate/dead imports
+  --rules              file with import rules, enforced on build
+  --check-rules        only check imports against --rules
     `
 
     fmt.Println(helpMSG)
@@ -468,9 +1092,34 @@ func printListing() {
   -M --main            =>   '%s'
   -I                   =>   %v
   -dot                 =>   '%s'
+  --dot-nostd          =>   %t
+  --dot-noext          =>   %t
+  --dot-cluster        =>   %t
+  --dot-color          =>   %t
+  --dot-label          =>   '%s'
+  --dot-reduce         =>   %t
+  --dot-focus          =>   '%s'
+  --dot-depth          =>   '%s'
+  --graph              =>   '%s'
+  --graph-fmt          =>   '%s'
+  --transitive         =>   %t
+  --json               =>   %t
+  --cache              =>   '%s'
+  --cache-url          =>   '%s'
+  --cache-max          =>   '%s'
+  --log-dir            =>   '%s'
+  --timings            =>   '%s'
+  --critical           =>   %t
+  --hermetic           =>   %t
+  --reproducible       =>   %t
+  --keep-work          =>   %t
+  --pack               =>   %t
+  --prefix             =>   '%s'
+  --link-mode          =>   '%s'
   -t --test            =>   %t
   -b --bench           =>   '%s'
   -m --match           =>   '%s'
+  --since              =>   '%s'
   -V --verbose         =>   %t
   --test-bin           =>   '%s'
   -f --fmt             =>   %t
@@ -479,6 +1128,9 @@ func printListing() {
   --tabwidth           =>   %s
   -e --external        =>   %t
   -B --backend         =>   '%s'
+  --lint-imports       =>   %t
+  --rules              =>   '%s'
+  --check-rules        =>   %t
 
 `
     tabRepr := "4"
@@ -506,9 +1158,34 @@ func printListing() {
         global.GetString("-main"),
         includes,
         global.GetString("-dot"),
+        global.GetBool("-dot-nostd"),
+        global.GetBool("-dot-noext"),
+        global.GetBool("-dot-cluster"),
+        global.GetBool("-dot-color"),
+        global.GetString("-dot-label"),
+        global.GetBool("-dot-reduce"),
+        global.GetString("-dot-focus"),
+        global.GetString("-dot-depth"),
+        global.GetString("-graph"),
+        global.GetString("-graph-fmt"),
+        global.GetBool("-transitive"),
+        global.GetBool("-json"),
+        global.GetString("-cache"),
+        global.GetString("-cache-url"),
+        global.GetString("-cache-max"),
+        global.GetString("-log-dir"),
+        global.GetString("-timings"),
+        global.GetBool("-critical"),
+        global.GetBool("-hermetic"),
+        global.GetBool("-reproducible"),
+        global.GetBool("-keep-work"),
+        global.GetBool("-pack"),
+        global.GetString("-prefix"),
+        global.GetString("-link-mode"),
         global.GetBool("-test"),
         global.GetString("-bench"),
         global.GetString("-match"),
+        global.GetString("-since"),
         global.GetBool("-verbose"),
         global.GetString("-test-bin"),
         global.GetBool("-fmt"),
@@ -516,5 +1193,8 @@ func printListing() {
         global.GetBool("-tab"),
         tabRepr,
         global.GetBool("-external"),
-        global.GetString("-backend"))
+        global.GetString("-backend"),
+        global.GetBool("-lint-imports"),
+        global.GetString("-rules"),
+        global.GetBool("-check-rules"))
 }
@@ -0,0 +1,286 @@
+// © Knug Industries 2011 all rights reserved
+// GNU GENERAL PUBLIC LICENSE VERSION 3.0
+// Author bjarneh@ifi.uio.no
+
+package cache
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "sort"
+    "time"
+    "http"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// A content addressed store for compiled objects, the key is
+// computed by the caller (hash of everything the object depends
+// on), the cache only knows how to store and fetch files.
+//
+//  Dir    : objects stored below a local directory
+//  HTTP   : GET/PUT objects to a remote server (url/key)
+//  Layers : look in several caches, fill the first ones on a hit
+
+type Cache interface {
+    Get(key, filename string) bool // write object to filename
+    Put(key, filename string) os.Error
+}
+
+///////////////////////////////////////////////////////////
+
+// size limit is applied by Trim, once per build, not on each Put
+type Dir struct {
+    root string
+}
+
+func NewDir(root string) *Dir {
+    c := new(Dir)
+    c.root = root
+    return c
+}
+
+func (c *Dir) path(key string) string {
+    if len(key) < 3 {
+        return filepath.Join(c.root, key)
+    }
+    return filepath.Join(c.root, key[:2], key)
+}
+
+func (c *Dir) Get(key, filename string) bool {
+
+    pathname := c.path(key)
+
+    if copyFile(pathname, filename) != nil {
+        return false
+    }
+
+    // trim removes the least recently used first
+    now := time.Nanoseconds()
+    os.Chtimes(pathname, now, now)
+
+    return true
+}
+
+func (c *Dir) Put(key, filename string) os.Error {
+
+    pathname := c.path(key)
+
+    e := os.MkdirAll(filepath.Dir(pathname), 0777)
+
+    if e != nil {
+        return e
+    }
+
+    return copyFile(filename, pathname)
+}
+
+// number of objects and their total size
+func (c *Dir) Stats() (objects int, size int64) {
+
+    entries := c.entries()
+
+    for i := 0; i < len(entries); i++ {
+        size += entries[i].info.Size
+    }
+
+    return len(entries), size
+}
+
+// remove least recently used objects until size <= max
+func (c *Dir) Trim(max int64) (removed int, freed int64) {
+
+    var size int64
+
+    entries := c.entries()
+
+    for i := 0; i < len(entries); i++ {
+        size += entries[i].info.Size
+    }
+
+    sort.Sort(byMtime(entries))
+
+    for i := 0; i < len(entries) && size > max; i++ {
+        if os.Remove(entries[i].path) == nil {
+            size -= entries[i].info.Size
+            freed += entries[i].info.Size
+            removed++
+        }
+    }
+
+    return removed, freed
+}
+
+func (c *Dir) Clear() os.Error {
+    return os.RemoveAll(c.root)
+}
+
+type entry struct {
+    path string
+    info *os.FileInfo
+}
+
+type byMtime []*entry
+
+func (b byMtime) Len() int           { return len(b) }
+func (b byMtime) Less(i, j int) bool { return b[i].info.Mtime_ns < b[j].info.Mtime_ns }
+func (b byMtime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (c *Dir) entries() []*entry {
+
+    entries := make([]*entry, 0)
+    dirs, e := ioutil.ReadDir(c.root)
+
+    if e != nil {
+        return entries
+    }
+
+    for i := 0; i < len(dirs); i++ {
+        if !dirs[i].IsDirectory() {
+            continue
+        }
+        dir := filepath.Join(c.root, dirs[i].Name)
+        files, e := ioutil.ReadDir(dir)
+        if e != nil {
+            continue
+        }
+        for j := 0; j < len(files); j++ {
+            if files[j].IsRegular() && !strings.HasPrefix(files[j].Name, ".") {
+                en := new(entry)
+                en.path = filepath.Join(dir, files[j].Name)
+                en.info = files[j]
+                entries = append(entries, en)
+            }
+        }
+    }
+
+    return entries
+}
+
+///////////////////////////////////////////////////////////
+
+type HTTP struct {
+    url string
+}
+
+func NewHTTP(url string) *HTTP {
+    c := new(HTTP)
+    c.url = strings.TrimRight(url, "/")
+    return c
+}
+
+func (c *HTTP) Get(key, filename string) bool {
+
+    resp, e := http.Get(c.url + "/" + key)
+
+    if e != nil {
+        return false
+    }
+
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return false
+    }
+
+    return writeFile(resp.Body, filename) == nil
+}
+
+func (c *HTTP) Put(key, filename string) os.Error {
+
+    b, e := ioutil.ReadFile(filename)
+
+    if e != nil {
+        return e
+    }
+
+    req, e := http.NewRequest("PUT", c.url+"/"+key, bytes.NewBuffer(b))
+
+    if e != nil {
+        return e
+    }
+
+    resp, e := http.DefaultClient.Do(req)
+
+    if e != nil {
+        return e
+    }
+
+    resp.Body.Close()
+
+    if resp.StatusCode/100 != 2 {
+        return os.NewError(fmt.Sprintf("[utilz/cache] PUT %s/%s: %s",
+            c.url, key, resp.Status))
+    }
+
+    return nil
+}
+
+///////////////////////////////////////////////////////////
+
+type Layers []Cache
+
+func (l Layers) Get(key, filename string) bool {
+    for i := 0; i < len(l); i++ {
+        if l[i].Get(key, filename) {
+            for j := 0; j < i; j++ {
+                l[j].Put(key, filename)
+            }
+            return true
+        }
+    }
+    return false
+}
+
+func (l Layers) Put(key, filename string) os.Error {
+    var err os.Error
+    for i := 0; i < len(l); i++ {
+        if e := l[i].Put(key, filename); e != nil {
+            err = e
+        }
+    }
+    return err
+}
+
+///////////////////////////////////////////////////////////
+
+func copyFile(src, dst string) os.Error {
+
+    in, e := os.Open(src)
+
+    if e != nil {
+        return e
+    }
+
+    defer in.Close()
+
+    return writeFile(in, dst)
+}
+
+// write to a temporary file first, so that nobody (concurrent
+// builds) sees a half written object, rename when done; the
+// temporary name starts with a dot, entries() skips leftovers
+func writeFile(r io.Reader, dst string) os.Error {
+
+    tmp := filepath.Join(filepath.Dir(dst),
+        fmt.Sprintf(".%s.tmp%d", filepath.Base(dst), os.Getpid()))
+
+    out, e := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+    if e != nil {
+        return e
+    }
+
+    _, e = io.Copy(out, r)
+    out.Close()
+
+    if e != nil {
+        os.Remove(tmp)
+        return e
+    }
+
+    return os.Rename(tmp, dst)
+}
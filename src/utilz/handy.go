@@ -6,16 +6,137 @@ package handy
 
 import (
     "os"
+    "fmt"
     "log"
     "io/ioutil"
     "regexp"
     "strings"
+    "bytes"
+    "sync"
+    "time"
     "exec"
 )
 
 
 // some utility functions
 
+// functions to run before the program exits (temporary files
+// and directories to remove), they are run in reverse order;
+// guarded by lock, Exit may be called from the signal handler
+var atExit = make([]func(), 0)
+
+func AtExit(f func()) {
+    lock.Lock()
+    atExit = append(atExit, f)
+    lock.Unlock()
+}
+
+// run (and forget) functions registered with AtExit, each one
+// runs once even if Cleanup is called from two goroutines
+func Cleanup() {
+
+    lock.Lock()
+    hooks := atExit
+    atExit = make([]func(), 0)
+    lock.Unlock()
+
+    for i := len(hooks) - 1; i >= 0; i-- {
+        hooks[i]()
+    }
+}
+
+// os.Exit after Cleanup
+func Exit(code int) {
+    Cleanup()
+    os.Exit(code)
+}
+
+// running child processes, and files they are writing (which
+// are only partially written if the process is interrupted)
+var children = make(map[int]*os.Process)
+var partial = make(map[string]bool)
+var interrupted bool // no new children once set
+var lock sync.Mutex
+
+// start cmd and wait for it, the process is known to Interrupt
+// while it runs
+func Run(cmd *exec.Cmd) os.Error {
+
+    // started and registered together, so Interrupt
+    // either sees the child or it is never started
+    lock.Lock()
+
+    if interrupted {
+        lock.Unlock()
+        return os.NewError("[utilz/handy] interrupted")
+    }
+
+    err := cmd.Start()
+
+    if err != nil {
+        lock.Unlock()
+        return err
+    }
+
+    children[cmd.Process.Pid] = cmd.Process
+    lock.Unlock()
+
+    err = cmd.Wait()
+
+    lock.Lock()
+    children[cmd.Process.Pid] = nil, false
+    lock.Unlock()
+
+    return err
+}
+
+// pathname (file or directory) is being written,
+// remove it if we are interrupted before Complete
+func Partial(pathname string) {
+    lock.Lock()
+    partial[pathname] = true
+    lock.Unlock()
+}
+
+func Complete(pathname string) {
+    lock.Lock()
+    partial[pathname] = false, false
+    lock.Unlock()
+}
+
+// forward sig to all running children, remove partial output
+func Interrupt(sig os.Signal) {
+
+    lock.Lock()
+    interrupted = true
+    for _, p := range children {
+        p.Signal(sig)
+    }
+    lock.Unlock()
+
+    // Run forgets children as they die, give them a second
+    for i := 0; i < 20 && runningChildren() > 0; i++ {
+        time.Sleep(50 * 1e6)
+    }
+
+    lock.Lock()
+    defer lock.Unlock()
+
+    for _, p := range children {
+        p.Kill()
+    }
+
+    for pathname, _ := range partial {
+        os.RemoveAll(pathname)
+    }
+}
+
+func runningChildren() int {
+    lock.Lock()
+    defer lock.Unlock()
+    return len(children)
+}
+
 func StdExecve(argv []string, stopOnTrouble bool) bool {
 
     var err os.Error
@@ -24,7 +145,8 @@ func StdExecve(argv []string, stopOnTrouble bool) bool {
     switch len(argv){
     case 0:
         if stopOnTrouble {
-            log.Fatalf("[ERROR] len(argv) == 0\n")
+            log.Printf("[ERROR] len(argv) == 0\n")
+            Exit(1)
         }
         return false
     case 1:
@@ -38,29 +160,64 @@ func StdExecve(argv []string, stopOnTrouble bool) bool {
     cmd.Stderr = os.Stderr
     cmd.Stdin  = os.Stdin
 
-    err = cmd.Start()
+    err = Run(cmd)
 
     if err != nil {
         if stopOnTrouble {
-            log.Fatalf("[ERROR] %s\n", err)
+            log.Printf("[ERROR] %s\n", err)
+            Exit(1)
         } else {
             log.Printf("[ERROR] %s\n", err)
             return false
         }
     }
 
-    err = cmd.Wait()
+    return true
+}
+
+
+// Run argv and return what it wrote to stdout,
+// stderr is passed through.
+func StdOutput(argv []string) ([]byte, os.Error) {
+
+    if len(argv) == 0 {
+        return nil, os.NewError("[utilz/handy] len(argv) == 0")
+    }
+
+    var stdout bytes.Buffer
+
+    cmd := exec.Command(argv[0], argv[1:]...)
+    cmd.Stdout = &stdout
+    cmd.Stderr = os.Stderr
+
+    err := Run(cmd)
+
+    return stdout.Bytes(), err
+}
+
+
+// Run argv and return everything it wrote to stdout and
+// stderr, the output is also returned if the command fails.
+func Capture(argv []string) ([]byte, bool) {
+
+    if len(argv) == 0 {
+        return []byte("[ERROR] len(argv) == 0\n"), false
+    }
+
+    var output bytes.Buffer
+
+    cmd := exec.Command(argv[0], argv[1:]...)
+    cmd.Stdout = &output
+    cmd.Stderr = &output
+
+    err := Run(cmd)
 
     if err != nil {
-        if stopOnTrouble {
-            log.Fatalf("[ERROR] %s\n", err)
-        } else {
-            log.Printf("[ERROR] %s\n", err)
-            return false
-        }
+        fmt.Fprintf(&output, "[ERROR] %s\n", err)
+        return output.Bytes(), false
     }
 
-    return true
+    return output.Bytes(), true
 }
 
 
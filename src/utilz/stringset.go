@@ -4,10 +4,14 @@
 
 package stringset
 
-import "strings"
+import (
+    "sort"
+    "strings"
+)
 
 
-// Use the built-in hash tables to construct a set of strings.
+// Use the built-in hash tables to construct a set of strings,
+// iteration (Iter, Slice, String) is in sorted order.
 
 
 type StringSet struct {
@@ -49,28 +53,26 @@ func (s *StringSet) Len() int {
     return len(s.elements)
 }
 
-func (s *StringSet) iterate(c chan<- string) {
-    for k, _ := range s.elements {
-        c <- k
+func iterate(slice []string, c chan<- string) {
+    for i := 0; i < len(slice); i++ {
+        c <- slice[i]
     }
     close(c)
 }
 
+// elements are copied first, so the set may be modified
+// while iterating
 func (s *StringSet) Iter() <-chan string {
     c := make(chan string)
-    go s.iterate(c)
+    go iterate(s.Slice(), c)
     return c
 }
 
 func (s *StringSet) String() string {
-    sarray := make([]string, len(s.elements)+2)
-    var i int = 1
-    for e, _ := range s.elements {
-        sarray[i] = e
-        i++
-    }
-    sarray[0] = "["
-    sarray[i] = "]"
+    sarray := make([]string, 0, len(s.elements)+2)
+    sarray = append(sarray, "[")
+    sarray = append(sarray, s.Slice()...)
+    sarray = append(sarray, "]")
     return strings.Join(sarray, " ")
 }
 
@@ -81,5 +83,6 @@ func (s *StringSet) Slice() []string {
         slice[i] = k
         i++
     }
+    sort.SortStrings(slice)
     return slice
 }
@@ -4,11 +4,15 @@ import (
     "testing"
     "strings"
     "os"
+    "http"
+    "http/httptest"
+    "io/ioutil"
     "path/filepath"
     "utilz/stringset"
     "utilz/stringbuffer"
     "utilz/walker"
     "utilz/timer"
+    "utilz/cache"
 )
 
 func TestStringSet(t *testing.T) {
@@ -38,6 +42,30 @@ func TestStringSet(t *testing.T) {
     if ss.Contains("not here") {
         t.Fatal(" stringset.Contains('not here')\n")
     }
+
+    ss.Add("tre")
+    ss.Add("fire")
+
+    slice := ss.Slice()
+    sorted := []string{"en", "fire", "to", "tre"}
+
+    if len(slice) != len(sorted) {
+        t.Fatalf("len(stringset.Slice()) != %d\n", len(sorted))
+    }
+
+    for i := 0; i < len(sorted); i++ {
+        if slice[i] != sorted[i] {
+            t.Fatalf("stringset.Slice() not sorted: %v\n", slice)
+        }
+    }
+
+    i := 0
+    for e := range ss.Iter() {
+        if e != sorted[i] {
+            t.Fatalf("stringset.Iter() not sorted: %s != %s\n", e, sorted[i])
+        }
+        i++
+    }
 }
 
 func TestStringBuffer(t *testing.T) {
@@ -98,10 +126,28 @@ func TestWalker(t *testing.T) {
     // this is a bit static, will cause problems if
     // stuff is added or removed == not ideal..
     ss.Add(filepath.Join(srcroot, "cmplr", "compiler.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "compiler_test.go"))
     ss.Add(filepath.Join(srcroot, "cmplr", "dag.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "lint.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "dot.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "export.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "query.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "progress.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "critical.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "hermetic.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "install.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "linkmode.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "cgo.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "sources.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "generate.go"))
+    ss.Add(filepath.Join(srcroot, "cmplr", "header.go"))
     ss.Add(filepath.Join(srcroot, "parse", "gopt.go"))
     ss.Add(filepath.Join(srcroot, "parse", "gopt_test.go"))
     ss.Add(filepath.Join(srcroot, "parse", "option.go"))
+    ss.Add(filepath.Join(srcroot, "parse", "rules.go"))
+    ss.Add(filepath.Join(srcroot, "parse", "rules_test.go"))
+    ss.Add(filepath.Join(srcroot, "parse", "diag.go"))
+    ss.Add(filepath.Join(srcroot, "parse", "diag_test.go"))
     ss.Add(filepath.Join(srcroot, "start", "main.go"))
     ss.Add(filepath.Join(srcroot, "utilz", "handy.go"))
     ss.Add(filepath.Join(srcroot, "utilz", "stringbuffer.go"))
@@ -111,6 +157,7 @@ func TestWalker(t *testing.T) {
     ss.Add(filepath.Join(srcroot, "utilz", "global.go"))
     ss.Add(filepath.Join(srcroot, "utilz", "timer.go"))
     ss.Add(filepath.Join(srcroot, "utilz", "say.go"))
+    ss.Add(filepath.Join(srcroot, "utilz", "cache.go"))
 
     files := walker.PathWalk(filepath.Clean(srcroot))
 
@@ -175,3 +222,101 @@ func TestTimer(t *testing.T) {
     }
 
 }
+
+func TestCache(t *testing.T) {
+
+    tmpdir, e := ioutil.TempDir("", "gdcache")
+
+    if e != nil {
+        t.Fatalf("ioutil.TempDir: %s\n", e)
+    }
+
+    defer os.RemoveAll(tmpdir)
+
+    object := filepath.Join(tmpdir, "object.6")
+    fetched := filepath.Join(tmpdir, "fetched.6")
+
+    e = ioutil.WriteFile(object, []byte("go object linux amd64"), 0644)
+
+    if e != nil {
+        t.Fatalf("ioutil.WriteFile: %s\n", e)
+    }
+
+    dir := cache.NewDir(filepath.Join(tmpdir, "cache"))
+
+    if dir.Get("abcdef", fetched) {
+        t.Fatal("empty cache.Dir returned an object\n")
+    }
+
+    if e = dir.Put("abcdef", object); e != nil {
+        t.Fatalf("cache.Dir.Put: %s\n", e)
+    }
+
+    if !dir.Get("abcdef", fetched) {
+        t.Fatal("cache.Dir.Get: missing object\n")
+    }
+
+    if b, _ := ioutil.ReadFile(fetched); string(b) != "go object linux amd64" {
+        t.Fatal("cache.Dir.Get: wrong content\n")
+    }
+
+    // leftover from a crashed Put, not an object
+    leftover := filepath.Join(tmpdir, "cache", "ab", ".abcdef.tmp1")
+    if e = ioutil.WriteFile(leftover, []byte("half"), 0644); e != nil {
+        t.Fatalf("ioutil.WriteFile: %s\n", e)
+    }
+
+    if n, size := dir.Stats(); n != 1 || size != 21 {
+        t.Fatalf("cache.Dir.Stats: %d objects, %d bytes\n", n, size)
+    }
+
+    if removed, _ := dir.Trim(0); removed != 1 {
+        t.Fatal("cache.Dir.Trim(0) should remove everything\n")
+    }
+
+    // local stand-in for a remote cache
+    stored := make(map[string][]byte)
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "PUT":
+            b, _ := ioutil.ReadAll(r.Body)
+            stored[r.URL.Path] = b
+        case "GET":
+            b, ok := stored[r.URL.Path]
+            if !ok {
+                w.WriteHeader(http.StatusNotFound)
+                return
+            }
+            w.Write(b)
+        }
+    }))
+
+    defer server.Close()
+
+    remote := cache.NewHTTP(server.URL)
+    layers := cache.Layers{dir, remote}
+
+    if layers.Get("123456", fetched) {
+        t.Fatal("empty cache.Layers returned an object\n")
+    }
+
+    if e = remote.Put("123456", object); e != nil {
+        t.Fatalf("cache.HTTP.Put: %s\n", e)
+    }
+
+    os.Remove(fetched)
+
+    if !layers.Get("123456", fetched) {
+        t.Fatal("cache.Layers.Get: missing remote object\n")
+    }
+
+    if b, _ := ioutil.ReadFile(fetched); string(b) != "go object linux amd64" {
+        t.Fatal("cache.HTTP.Get: wrong content\n")
+    }
+
+    // a remote hit should fill the local cache
+    if n, _ := dir.Stats(); n != 1 {
+        t.Fatal("cache.Layers.Get: local cache not filled\n")
+    }
+}
@@ -14,12 +14,12 @@ _gd(){
 
     local cur prev opts gd_long_opts gd_short_opts gd_short_explain
     # long options
-    gd_long_opts="--help --version --list --print --sort --output --static --arch --dryrun --clean --dot --test --benchmarks --match --verbose --test-bin --fmt --rew-rule --tab --tabwidth --no-comments --external --quiet --lib --main --backend"
+    gd_long_opts="--help --version --list --print --sort --output --static --arch --dryrun --clean --dot --test --benchmarks --match --verbose --test-bin --fmt --rew-rule --tab --tabwidth --no-comments --external --quiet --lib --main --backend --lint-imports --rules --check-rules --dot-nostd --dot-noext --dot-cluster --dot-color --dot-label --dot-reduce --dot-focus --dot-depth --graph --graph-fmt --transitive --json --since --cache --cache-url --cache-max --log-dir --timings --critical --hermetic --reproducible --keep-work --pack --prefix --link-mode"
     # short options + explain
     gd_short_explain="-h[--help] -v[--version] -l[--list] -p[--print] -s[--sort] -o[--output] -S[--static] -a[--arch] -d[--dryrun] -c[--clean] -I -t[--test] -b[--bench] -m[--match] -V[--verbose] -f[--fmt] -e[--external] -q[--quiet] -L[--lib] -M[--main] -B[--backend]"
     # short options
     gd_short_opts="-h -v -l -p -s -o -S -a -d -c -I -t -b -m -V -f -q -B"
-    gd_special="clean test"
+    gd_special="clean test query cache verify-repro install uninstall"
 
 
     COMPREPLY=()
@@ -39,7 +39,15 @@ _gd(){
         fi
         return 0
     fi
-    if [[ "${cur}" == c* || "${cur}" == t* ]]; then
+    if [[ "${prev}" == "query" ]]; then
+        COMPREPLY=( $(compgen -W "deps rdeps path leaves roots affected" -- "${cur}") )
+        return 0
+    fi
+    if [[ "${prev}" == "cache" ]]; then
+        COMPREPLY=( $(compgen -W "stats trim clear" -- "${cur}") )
+        return 0
+    fi
+    if [[ "${cur}" == c* || "${cur}" == t* || "${cur}" == q* || "${cur}" == v* || "${cur}" == i* || "${cur}" == u* ]]; then
         COMPREPLY=( $(compgen -W "${gd_special}" -- "${cur}") )
     fi
     if [[ "${prev}" == -* ]]; then
@@ -56,6 +64,10 @@ _gd(){
                 COMPREPLY=( $(compgen -W "gc gccgo express" -- "${cur}") )
                 return 0
                 ;;
+            '-graph-fmt' | '--graph-fmt' | '-graph-fmt=' | '--graph-fmt=')
+                COMPREPLY=( $(compgen -W "graphml json mermaid html svg" -- "${cur}") )
+                return 0
+                ;;
         esac
     fi
 }